@@ -0,0 +1,141 @@
+package bridges
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/gin-gonic/gin"
+)
+
+// adminPrefix is the path under which the admin API is served.
+const adminPrefix = "/admin/"
+
+// newAdmin build the admin API managing the mapper schemas at runtime. Every request must carry the token as a
+// bearer Authorization header.
+func newAdmin(ctx log.Interface, mapper *Mapper, token string) *gin.Engine {
+	engine := gin.New()
+	engine.Use(
+		Logger(ctx.WithField("api", "admin")),
+		requestID,
+		jsonError,
+		checkToken(token),
+	)
+	a := &admin{mapper: mapper}
+	engine.POST(adminPrefix+"reload", a.reload)
+	group := engine.Group(adminPrefix + "schemas")
+	group.GET("", a.list)
+	group.GET("/:key", a.get)
+	group.PUT("/:key", a.set)
+	group.DELETE("/:key", a.delete)
+	engine.GET(adminPrefix+"devices", a.devices)
+	engine.GET(adminPrefix+"devices/:id", a.device)
+	return engine
+}
+
+type admin struct {
+	mapper *Mapper
+}
+
+func checkToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.GetHeader("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			fail(c, http.StatusUnauthorized, codeUnauthorized, errors.New("missing or invalid bearer token"))
+		}
+	}
+}
+
+// list answer the schemas as they are defined, without the fields they inherit.
+func (a *admin) list(c *gin.Context) {
+	c.JSON(http.StatusOK, a.mapper.Raw())
+}
+
+// reload read the mapper file again, and the device registry file if there is one.
+func (a *admin) reload(c *gin.Context) {
+	if err := a.mapper.Reload(); err != nil {
+		fail(c, http.StatusUnprocessableEntity, codeInvalidSchema, err)
+		return
+	}
+	if a.mapper.Devices != nil {
+		if err := a.mapper.Devices.Reload(); err != nil {
+			fail(c, http.StatusUnprocessableEntity, codeInvalidSchema, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, a.mapper.Raw())
+}
+
+func (a *admin) get(c *gin.Context) {
+	sch, ok := a.mapper.Raw()[c.Param("key")]
+	if !ok {
+		fail(c, http.StatusNotFound, codeUnknownSchema, fmt.Errorf("no schema found for %s", c.Param("key")))
+		return
+	}
+	c.JSON(http.StatusOK, sch)
+}
+
+// set create or replace a schema. It answer 201 when the schema didn't exist.
+func (a *admin) set(c *gin.Context) {
+	key := c.Param("key")
+	sch := &Schema{}
+	if err := json.NewDecoder(c.Request.Body).Decode(sch); err != nil {
+		fail(c, http.StatusBadRequest, codeInvalidJSON, err)
+		return
+	}
+	if err := a.mapper.Check(key, sch); err != nil {
+		fail(c, http.StatusUnprocessableEntity, codeInvalidSchema, err)
+		return
+	}
+	exists := a.mapper.Defined(key)
+	if err := a.mapper.Set(key, sch); err != nil {
+		fail(c, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	c.JSON(status, sch)
+}
+
+func (a *admin) delete(c *gin.Context) {
+	key := c.Param("key")
+	if !a.mapper.Defined(key) {
+		fail(c, http.StatusNotFound, codeUnknownSchema, fmt.Errorf("no schema found for %s", key))
+		return
+	}
+	if err := a.mapper.Check(key, nil); err != nil {
+		fail(c, http.StatusConflict, codeSchemaInUse, err)
+		return
+	}
+	if err := a.mapper.Delete(key); err != nil {
+		fail(c, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// devices answer the device registry.
+func (a *admin) devices(c *gin.Context) {
+	if a.mapper.Devices == nil {
+		fail(c, http.StatusNotFound, codeUnknownDevice, errors.New("no device registry"))
+		return
+	}
+	c.JSON(http.StatusOK, a.mapper.Devices.All())
+}
+
+func (a *admin) device(c *gin.Context) {
+	dev, ok := a.mapper.Devices.Get(c.Param("id"))
+	if !ok {
+		failEntity(c, http.StatusNotFound, codeUnknownDevice, c.Param("id"), fmt.Errorf("no device found for %s", c.Param("id")))
+		return
+	}
+	c.JSON(http.StatusOK, dev)
+}
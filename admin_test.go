@@ -0,0 +1,64 @@
+package bridges
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestAdmin(t *testing.T) {
+	a := assertions.New(t)
+	mapper := NewMapper(nil)
+	engine := newAdmin(log.Get(), mapper, "secret")
+	do := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	a.So(do("GET", "/admin/schemas", "", ""), assertions.ShouldEqual, http.StatusUnauthorized)
+	a.So(do("GET", "/admin/schemas", "wrong", ""), assertions.ShouldEqual, http.StatusUnauthorized)
+	a.So(do("PUT", "/admin/schemas/tank", "secret", `{"attrs":{"level":"meter"}}`), assertions.ShouldEqual, http.StatusCreated)
+	a.So(do("PUT", "/admin/schemas/tank", "secret", `{"attrs":{"level":"liter"}}`), assertions.ShouldEqual, http.StatusOK)
+	a.So(do("PUT", "/admin/schemas/tank", "secret", `{"attrs":{}}`), assertions.ShouldEqual, http.StatusUnprocessableEntity)
+	sch, _ := mapper.Get("tank")
+	a.So(sch.Attrs["level"], assertions.ShouldEqual, "liter")
+	a.So(do("GET", "/admin/schemas/tank", "secret", ""), assertions.ShouldEqual, http.StatusOK)
+	a.So(do("DELETE", "/admin/schemas/tank", "secret", ""), assertions.ShouldEqual, http.StatusNoContent)
+	a.So(do("GET", "/admin/schemas/tank", "secret", ""), assertions.ShouldEqual, http.StatusNotFound)
+
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/schemas/tank", nil))
+	var env errorEnvelope
+	a.So(json.Unmarshal(rec.Body.Bytes(), &env), assertions.ShouldBeNil)
+	a.So(env.Code, assertions.ShouldEqual, codeUnauthorized)
+	a.So(env.RequestID, assertions.ShouldNotBeEmpty)
+}
+
+func TestAdminDevices(t *testing.T) {
+	a := assertions.New(t)
+	mapper := NewMapper(nil)
+	engine := newAdmin(log.Get(), mapper, "secret")
+	do := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	a.So(do("/admin/devices"), assertions.ShouldEqual, http.StatusNotFound)
+	mapper.Devices = NewRegistry(map[string]*Device{"tank-1": {Params: map[string]interface{}{"capacity": 100.0}}})
+	a.So(do("/admin/devices"), assertions.ShouldEqual, http.StatusOK)
+	a.So(do("/admin/devices/tank-1"), assertions.ShouldEqual, http.StatusOK)
+	a.So(do("/admin/devices/tank-2"), assertions.ShouldEqual, http.StatusNotFound)
+}
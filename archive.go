@@ -0,0 +1,229 @@
+package bridges
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// archiveDay is the layout of the day in the archive file names.
+const archiveDay = "2006-01-02"
+
+// ArchiveRecord is a raw inbound message, with the schema key it was received for.
+type ArchiveRecord struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Schema string    `json:"schema"`
+	Body   string    `json:"body"`
+}
+
+// Replay convert the message with the schema key, its own one when key is empty, and push it to the broker. The
+// entities are timestamped with the time the message was received.
+func (r *ArchiveRecord) Replay(ctx log.Interface, mapper *Mapper, broker *ngsi.Client, key string) error {
+	if key == "" {
+		key = r.Schema
+	}
+	return replay(ctx, mapper, broker, key, []byte(r.Body), r.Time)
+}
+
+// replay convert a stored message with the current schemas and push it to the broker, timestamped at, the time it
+// was received.
+func replay(ctx log.Interface, mapper *Mapper, broker *ngsi.Client, key string, body []byte, at time.Time) error {
+	ents, err := Convert(ctx, mapper, key, body)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		ent.Attributes["timestamp"] = ngsi.Attribute{
+			AttrPair: ngsi.AttrPair{
+				Type:  "time",
+				Value: at.UTC(),
+			},
+		}
+	}
+	sch, _ := mapper.Get(key)
+	return push(ctx, broker, nil, sch, ents)
+}
+
+// Archive append every inbound message to compressed JSON lines files per UTC day. Each process start new files,
+// numbered after the ones of the day like 2019-01-16.2.jsonl.gz, so a file left unfinished by a crash is never
+// appended to.
+type Archive struct {
+	dir  string
+	mu   sync.Mutex
+	day  string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// OpenArchive return the archive of the directory dir, creating it if needed.
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{dir: dir}, nil
+}
+
+// Append archive the message body from source, like http or ttn, received for the schema key. A nil archive drop it.
+func (a *Archive) Append(source, key string, body []byte) error {
+	if a == nil {
+		return nil
+	}
+	r := &ArchiveRecord{Time: now().UTC(), Source: source, Schema: key, Body: string(body)}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err = a.rotate(r.Time.Format(archiveDay)); err != nil {
+		return err
+	}
+	if _, err = a.gz.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Flushing every record keep the file readable up to the last message if the bridge stop abruptly.
+	return a.gz.Flush()
+}
+
+// rotate switch to the file of day when it isn't the current one.
+func (a *Archive) rotate(day string) error {
+	if day == a.day && a.gz != nil {
+		return nil
+	}
+	if err := a.close(); err != nil {
+		return err
+	}
+	files, err := archiveFiles(a.dir, day)
+	if err != nil {
+		return err
+	}
+	// Another file may be created meanwhile by another bridge sharing the directory, the next number is tried.
+	for n := len(files) + 1; ; n++ {
+		file, err := os.OpenFile(archiveFile(a.dir, day, n), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		a.day, a.file, a.gz = day, file, gzip.NewWriter(file)
+		return nil
+	}
+}
+
+// archiveFile return the name of the file n of day.
+func archiveFile(dir, day string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%d.jsonl.gz", day, n))
+}
+
+// archiveFiles return the files of day, in the order they were written.
+func archiveFiles(dir, day string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, day+".*.jsonl.gz"))
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]int, len(matches))
+	files := matches[:0]
+	for _, file := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), day+"."), ".jsonl.gz"))
+		if err != nil {
+			continue
+		}
+		numbers[file] = n
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return numbers[files[i]] < numbers[files[j]] })
+	return files, nil
+}
+
+// Close finish the current file.
+func (a *Archive) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.close()
+}
+
+func (a *Archive) close() error {
+	if a.gz == nil {
+		return nil
+	}
+	err := a.gz.Close()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.gz, a.file, a.day = nil, nil, ""
+	return err
+}
+
+// ReadArchive call fn with the records of the archive directory dir received from from, included, to to, excluded,
+// in the order they were received.
+func ReadArchive(dir string, from, to time.Time, fn func(*ArchiveRecord) error) error {
+	from, to = from.UTC(), to.UTC()
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		files, err := archiveFiles(dir, day.Format(archiveDay))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			err = readArchiveFile(file, func(r *ArchiveRecord) error {
+				if r.Time.Before(from) || !r.Time.Before(to) {
+					return nil
+				}
+				return fn(r)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readArchiveFile(file string, fn func(*ArchiveRecord) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid archive %s: %s", file, err)
+	}
+	defer gz.Close()
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		r := &ArchiveRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return fmt.Errorf("%s:%d: %s", file, line, err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	// The file of a bridge that stopped abruptly end without gzip trailer, its flushed records are still read.
+	if err = scanner.Err(); err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package bridges
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestArchive(t *testing.T) {
+	a := assertions.New(t)
+	dir, err := ioutil.TempDir("", "archive")
+	a.So(err, assertions.ShouldBeNil)
+	defer os.RemoveAll(dir)
+	at := time.Date(2019, 1, 16, 23, 59, 0, 0, time.UTC)
+	now = func() time.Time { return at }
+	defer func() { now = time.Now }()
+
+	var nilArchive *Archive
+	a.So(nilArchive.Append("http", "particle", []byte("{}")), assertions.ShouldBeNil)
+	archive, err := OpenArchive(dir)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(archive.Append("http", "particle", []byte(`{"n": 1}`)), assertions.ShouldBeNil)
+	at = at.Add(time.Minute)
+	a.So(archive.Append("ttn", "ttn", []byte(`{"n": 2}`)), assertions.ShouldBeNil)
+	a.So(archive.Close(), assertions.ShouldBeNil)
+
+	// After a restart the records go to a new file of the day, the bridge crash without closing it.
+	archive, err = OpenArchive(dir)
+	a.So(err, assertions.ShouldBeNil)
+	at = at.Add(time.Minute)
+	a.So(archive.Append("http", "particle", []byte(`{"n": 3}`)), assertions.ShouldBeNil)
+
+	// The file left unfinished by the crash is not appended to.
+	archive, err = OpenArchive(dir)
+	a.So(err, assertions.ShouldBeNil)
+	at = at.Add(time.Minute)
+	a.So(archive.Append("http", "particle", []byte(`{"n": 4}`)), assertions.ShouldBeNil)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	a.So(err, assertions.ShouldBeNil)
+	a.So(files, assertions.ShouldResemble, []string{
+		filepath.Join(dir, "2019-01-16.1.jsonl.gz"),
+		filepath.Join(dir, "2019-01-17.1.jsonl.gz"),
+		filepath.Join(dir, "2019-01-17.2.jsonl.gz"),
+		filepath.Join(dir, "2019-01-17.3.jsonl.gz"),
+	})
+
+	var bodies []string
+	read := func(from, to time.Time) {
+		bodies = nil
+		a.So(ReadArchive(dir, from, to, func(r *ArchiveRecord) error {
+			bodies = append(bodies, r.Body)
+			return nil
+		}), assertions.ShouldBeNil)
+	}
+	read(time.Date(2019, 1, 16, 0, 0, 0, 0, time.UTC), time.Date(2019, 1, 18, 0, 0, 0, 0, time.UTC))
+	a.So(bodies, assertions.ShouldResemble, []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`, `{"n": 4}`})
+	read(time.Date(2019, 1, 17, 0, 0, 0, 0, time.UTC), time.Date(2019, 1, 17, 0, 1, 0, 0, time.UTC))
+	a.So(bodies, assertions.ShouldResemble, []string{`{"n": 2}`})
+
+	// Replayed entities are timestamped when the message was received, not when it is replayed.
+	var pushed string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buff, _ := ioutil.ReadAll(r.Body)
+		pushed = string(buff)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer broker.Close()
+	mapper := NewMapper(map[string]*Schema{"tank": {Attrs: map[string]string{"level": "liters"}}})
+	r := &ArchiveRecord{Time: time.Date(2019, 1, 16, 12, 0, 0, 0, time.UTC), Schema: "tank", Body: `{"id": "tank-1", "level": 10}`}
+	a.So(r.Replay(log.Get(), mapper, ngsi.NewClient(broker.URL), ""), assertions.ShouldBeNil)
+	a.So(pushed, assertions.ShouldContainSubstring, `"2019-01-16T12:00:00Z"`)
+}
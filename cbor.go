@@ -0,0 +1,226 @@
+package bridges
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxCBORDepth limit the nesting of arrays and maps in a CBOR message.
+const maxCBORDepth = 32
+
+var errCBORShort = errors.New("unexpected end of data")
+
+// unmarshalCBOR decode a CBOR (RFC 7049) item into the same types as encoding/json: numbers are float64, maps have
+// string keys. Byte strings are kept as []byte and tags are ignored.
+func unmarshalCBOR(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.(cborBreak); ok {
+		return nil, errors.New("unexpected break")
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%d bytes after CBOR item", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// cborBreak is returned by item when it reads the end of an indefinite length item.
+type cborBreak struct{}
+
+func (d *cborDecoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBORShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head read the major type and argument of an item. indefinite is true for the indefinite length marker.
+func (d *cborDecoder) head() (major byte, arg uint64, indefinite bool, err error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info == 31:
+		return major, 0, true, nil
+	case info > 27:
+		return 0, 0, false, fmt.Errorf("invalid additional information %d", info)
+	}
+	b, err = d.read(1 << (info - 24))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	switch len(b) {
+	case 1:
+		arg = uint64(b[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(b))
+	default:
+		arg = binary.BigEndian.Uint64(b)
+	}
+	return major, arg, false, nil
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, errors.New("too deeply nested")
+	}
+	start := d.pos
+	major, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && major != 2 && major != 3 && major != 4 && major != 5 && major != 7 {
+		return nil, fmt.Errorf("indefinite length for major type %d", major)
+	}
+	switch major {
+	case 0:
+		return float64(arg), nil
+	case 1:
+		return -1 - float64(arg), nil
+	case 2, 3:
+		b, err := d.str(major, arg, indefinite)
+		if err != nil || major == 2 {
+			return b, err
+		}
+		return string(b), nil
+	case 4:
+		arr := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(cborBreak); ok {
+				if !indefinite {
+					return nil, errors.New("unexpected break")
+				}
+				break
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 5:
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := k.(cborBreak); ok {
+				if !indefinite {
+					return nil, errors.New("unexpected break")
+				}
+				break
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(cborBreak); ok {
+				return nil, errors.New("unexpected break")
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			m[key] = v
+		}
+		return m, nil
+	case 6:
+		v, err := d.item(depth + 1)
+		if _, ok := v.(cborBreak); ok {
+			return nil, errors.New("unexpected break")
+		}
+		return v, err
+	default:
+		return d.simple(d.data[start]&0x1f, arg, indefinite)
+	}
+}
+
+// str read a byte or text string, joining the chunks of an indefinite length string.
+func (d *cborDecoder) str(major byte, arg uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		b, err := d.read(arg)
+		return append([]byte{}, b...), err
+	}
+	var out []byte
+	for {
+		m, n, ind, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m == 7 && ind {
+			return out, nil
+		}
+		if m != major || ind {
+			return nil, errors.New("invalid indefinite string chunk")
+		}
+		b, err := d.read(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+}
+
+// simple read the values of major type 7: booleans, null, floats and the break marker.
+func (d *cborDecoder) simple(info byte, arg uint64, indefinite bool) (interface{}, error) {
+	if indefinite {
+		return cborBreak{}, nil
+	}
+	switch {
+	case info == 25:
+		return halfFloat(uint16(arg)), nil
+	case info == 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case info == 27:
+		return math.Float64frombits(arg), nil
+	case arg == 20:
+		return false, nil
+	case arg == 21:
+		return true, nil
+	case arg == 22, arg == 23:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported simple value %d", arg)
+}
+
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
@@ -2,30 +2,114 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
 	"ngsi-bridge"
+	"ngsi-bridge/ngsi"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/go-utils/log/apex"
-	"gopkg.in/yaml.v2"
 )
 
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
 var (
-	bridge     string
-	appID      string
-	appKey     string
-	account    string
-	discovery  string
-	httpPort   int
-	mapperFile string
-	brokerURL  string
-	httpMethod string
+	version = "dev"
+	commit  string
+	date    string
+)
+
+var (
+	bridge      string
+	appID       string
+	appKey      string
+	account     string
+	discovery   string
+	httpPort    int
+	mapperFile  string
+	devicesFile string
+	changesFile string
+	deadLetters string
+	archiveDir  string
+	historyDir  string
+	routesFile  string
+	brokerURL   string
+	httpMethod  string
+
+	reloadInterval time.Duration
+	adminToken     string
+	historyToken   string
+	persistSchemas bool
+
+	brokerTimeout    time.Duration
+	brokerRetries    int
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	workers   int
+	queueSize int
+	overflow  string
+
+	outboxThreshold int
+
+	rateGlobal string
+	rateSchema string
+	rateEntity string
+	rateClient string
+
+	authHeader       string
+	token            string
+	oauthURL         string
+	oauthClient      string
+	oauthSecret      string
+	oauthScopes      string
+	keystoneURL      string
+	keystoneUser     string
+	keystonePassword string
+	keystoneDomain   string
+	keystoneProject  string
 )
 
 func init() {
 	flag.StringVar(&bridge, "type", "ttn", "Bridge type")
 	flag.StringVar(&brokerURL, "broker", "http://localhost:1026/ngsi10/updateContext", "Fiware broker url")
 	flag.StringVar(&mapperFile, "mapper", "./mapper.yml", "message mapper configuratio")
+	flag.StringVar(&devicesFile, "devices", "", "Device registry file, YAML or CSV, empty for none")
+	flag.DurationVar(&reloadInterval, "reloadInterval", 5*time.Second, "Interval between two checks of the mapper and device files for changes")
+	flag.StringVar(&changesFile, "changeCache", "", "File persisting the last pushed values of the schemas reporting by exception, empty to keep them in memory")
+	flag.StringVar(&deadLetters, "deadLetters", "", "Directory storing the messages that could not be converted or pushed, empty for none")
+	flag.StringVar(&archiveDir, "archive", "", "Directory archiving every message received, empty for none")
+	flag.StringVar(&historyDir, "history", "", "Directory recording the attribute values of the entities, served under /history/, empty for none")
+	flag.StringVar(&routesFile, "routes", "", "Routes file sending the entities to other brokers and webhooks, empty to only use -broker")
+	flag.StringVar(&adminToken, "adminToken", "", "Bearer token of the schema admin API, empty disable the API")
+	flag.StringVar(&historyToken, "historyToken", "", "Bearer token of the history API, -adminToken when empty, the history isn't served without token")
+	flag.BoolVar(&persistSchemas, "persist", false, "Write schema changes made with the admin API back to the mapper file")
+	flag.DurationVar(&brokerTimeout, "timeout", ngsi.DefaultTimeout, "Broker request timeout")
+	flag.IntVar(&brokerRetries, "retries", ngsi.DefaultRetry.Attempts, "Broker request attempts, 1 disable retries")
+	flag.IntVar(&breakerThreshold, "breakerThreshold", 5, "Consecutive broker failures opening the circuit breaker, 0 disable it")
+	flag.DurationVar(&breakerCooldown, "breakerCooldown", 30*time.Second, "Time the circuit breaker stays open")
+	// Dispatch
+	flag.IntVar(&workers, "workers", 8, "Workers pushing the messages, the messages of an entity are pushed in order")
+	flag.IntVar(&queueSize, "queueSize", 100, "Messages queued by worker")
+	flag.StringVar(&overflow, "overflow", "block", "What to do with a message when the queue is full: block, drop-oldest or reject")
+	flag.IntVar(&outboxThreshold, "outboxThreshold", 0, "Queued messages above which the bridge is not ready, 0 for 80% of the queues")
+	// Rate limits
+	flag.StringVar(&rateGlobal, "rateGlobal", "", "Rate limit of all the messages, like 100/1s or 6000/m:200 with a burst, empty for none")
+	flag.StringVar(&rateSchema, "rateSchema", "", "Rate limit of the messages of each schema key, empty for none")
+	flag.StringVar(&rateEntity, "rateEntity", "", "Rate limit of the messages of each entity, empty for none")
+	flag.StringVar(&rateClient, "rateClient", "", "Rate limit of the requests of each HTTP client, empty for none")
+	// Broker authentication
+	flag.StringVar(&authHeader, "authHeader", "X-Auth-Token", "Header used to send the broker token")
+	flag.StringVar(&token, "token", "", "Static broker token")
+	flag.StringVar(&oauthURL, "oauthURL", "", "OAuth2 token URL (Keyrock, Keycloak)")
+	flag.StringVar(&oauthClient, "oauthClient", "", "OAuth2 client ID")
+	flag.StringVar(&oauthSecret, "oauthSecret", "", "OAuth2 client secret")
+	flag.StringVar(&oauthScopes, "oauthScopes", "", "OAuth2 scopes, comma separated")
+	flag.StringVar(&keystoneURL, "keystoneURL", "", "Keystone URL")
+	flag.StringVar(&keystoneUser, "keystoneUser", "", "Keystone user name")
+	flag.StringVar(&keystonePassword, "keystonePassword", "", "Keystone password")
+	flag.StringVar(&keystoneDomain, "keystoneDomain", "Default", "Keystone user and project domain")
+	flag.StringVar(&keystoneProject, "keystoneProject", "", "Keystone project scope")
 	// TTN
 	flag.StringVar(&appID, "appID", "", "TTN application ID")
 	flag.StringVar(&appKey, "appKey", "", "TTN application Key")
@@ -39,16 +123,81 @@ func init() {
 
 func main() {
 	flag.Parse()
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(validate(flag.Args()[1:]))
+	case "simulate":
+		os.Exit(simulate(flag.Args()[1:]))
+	case "deadletter":
+		os.Exit(deadletter(flag.Args()[1:]))
+	case "replay":
+		os.Exit(replay(flag.Args()[1:]))
+	}
 	b := bridges.NewHttpBridge(httpPort)
 	aLog := apex.Stdout()
 	aLog.Level = apex.DebugLevel
 
-	mapperConf, err := getMapperSchema(mapperFile)
+	mapper, err := bridges.LoadMapper(mapperFile)
 	if err != nil {
 		aLog.Error(err.Error())
 		os.Exit(-1)
 	}
-	b.Prepare(aLog, mapperConf, brokerURL, httpMethod)
+	mapper.Persist = persistSchemas
+	defer mapper.Watch(aLog, reloadInterval)()
+	if devicesFile != "" {
+		if mapper.Devices, err = bridges.LoadRegistry(devicesFile); err != nil {
+			aLog.Error(err.Error())
+			os.Exit(-1)
+		}
+		defer mapper.Devices.Watch(aLog, reloadInterval)()
+	}
+	b.AdminToken = adminToken
+	b.HistoryToken = historyToken
+	if b.Changes, err = bridges.LoadChangeCache(changesFile); err != nil {
+		aLog.Error(err.Error())
+		os.Exit(-1)
+	}
+	defer b.Changes.Persist(aLog, reloadInterval)()
+	// The router is closed after the dispatcher, whose queued messages are still routed.
+	if routesFile != "" {
+		if b.Routes, err = bridges.LoadRouter(aLog, routesFile); err != nil {
+			aLog.Error(err.Error())
+			os.Exit(-1)
+		}
+		defer b.Routes.Close()
+	}
+	b.Dedup = bridges.NewDeduplicator()
+	if b.Dispatch, err = newDispatcher(); err != nil {
+		aLog.Error(err.Error())
+		os.Exit(-1)
+	}
+	defer b.Dispatch.Close()
+	if b.Limits, err = newRateLimiter(); err != nil {
+		aLog.Error(err.Error())
+		os.Exit(-1)
+	}
+	if archiveDir != "" {
+		if b.Archive, err = bridges.OpenArchive(archiveDir); err != nil {
+			aLog.Error(err.Error())
+			os.Exit(-1)
+		}
+		defer b.Archive.Close()
+	}
+	if historyDir != "" {
+		if b.History, err = bridges.OpenFileHistory(historyDir); err != nil {
+			aLog.Error(err.Error())
+			os.Exit(-1)
+		}
+	}
+	if deadLetters != "" {
+		if b.DeadLetters, err = bridges.OpenDeadLetters(deadLetters); err != nil {
+			aLog.Error(err.Error())
+			os.Exit(-1)
+		}
+	}
+	broker := newBrokerClient()
+	b.Health = newHealth(aLog, mapper, broker, b.Dispatch)
+	b.Prepare(aLog, mapper, broker, httpMethod)
 	if err = b.Open(); err != nil {
 		aLog.Error(err.Error())
 		os.Exit(-1)
@@ -56,15 +205,78 @@ func main() {
 	return
 }
 
-func getMapperSchema(filename string) (map[string]*bridges.Schema, error) {
-	buff, err := ioutil.ReadFile(filename)
+// newDispatcher build the worker pool shared by the bridges.
+func newDispatcher() (*bridges.Dispatcher, error) {
+	o, err := bridges.ParseOverflow(overflow)
 	if err != nil {
 		return nil, err
 	}
-	m := map[string]*bridges.Schema{}
-	err = yaml.Unmarshal(buff, &m)
-	if err != nil {
-		return nil, err
+	return bridges.NewDispatcher(workers, queueSize, o)
+}
+
+// newHealth build the readiness checks: schemas loaded, broker reachable and queues below the outbox threshold.
+func newHealth(ctx log.Interface, mapper *bridges.Mapper, broker *ngsi.Client, dispatch *bridges.Dispatcher) *bridges.Health {
+	h := bridges.NewHealth(bridges.BuildInfo{Version: version, Commit: commit, Date: date})
+	h.Add("mapper", bridges.MapperCheck(mapper))
+	h.Add("broker", bridges.BrokerCheck(ctx, broker))
+	threshold := outboxThreshold
+	if threshold <= 0 {
+		threshold = dispatch.Capacity() * 8 / 10
+	}
+	h.Add("outbox", bridges.QueueCheck(dispatch, threshold))
+	return h
+}
+
+// newRateLimiter build the rate limiter shared by the bridges, the schemas can override its schema and entity rates.
+func newRateLimiter() (*bridges.RateLimiter, error) {
+	l := &bridges.RateLimiter{}
+	for _, r := range []struct {
+		flag string
+		rate *bridges.Rate
+	}{
+		{rateGlobal, &l.Global},
+		{rateSchema, &l.Schema},
+		{rateEntity, &l.Entity},
+		{rateClient, &l.Client},
+	} {
+		var err error
+		if *r.rate, err = bridges.ParseRate(r.flag); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// newBrokerClient build the broker client with the timeouts, circuit breaker and token source selected by the flags.
+func newBrokerClient() *ngsi.Client {
+	client := ngsi.NewClient(brokerURL)
+	client.HTTP.Timeout = brokerTimeout
+	client.Retry.Attempts = brokerRetries
+	if breakerThreshold > 0 {
+		client.Breaker = ngsi.NewBreaker(brokerURL, breakerThreshold, breakerCooldown)
+	}
+	client.AuthHeader = authHeader
+	switch {
+	case token != "":
+		client.Tokens = ngsi.StaticToken(token)
+	case oauthURL != "":
+		o := ngsi.OAuth2{
+			TokenURL:     oauthURL,
+			ClientID:     oauthClient,
+			ClientSecret: oauthSecret,
+		}
+		if oauthScopes != "" {
+			o.Scopes = strings.Split(oauthScopes, ",")
+		}
+		client.Tokens = o.TokenSource()
+	case keystoneURL != "":
+		client.Tokens = ngsi.Keystone{
+			URL:      keystoneURL,
+			User:     keystoneUser,
+			Password: keystonePassword,
+			Domain:   keystoneDomain,
+			Project:  keystoneProject,
+		}.TokenSource()
 	}
-	return m, nil
+	return client
 }
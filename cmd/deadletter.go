@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ngsi-bridge"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log/apex"
+)
+
+// deadletter manage the dead-letter store: list the messages, show one or replay them, all or the given IDs, with
+// the current schemas. Replayed messages are removed from the store. It return the process exit code.
+func deadletter(args []string) int {
+	flags := flag.NewFlagSet("deadletter", flag.ExitOnError)
+	dir := flags.String("dir", deadLetters, "Dead-letter directory")
+	mapper := flags.String("mapper", mapperFile, "message mapper configuration")
+	devices := flags.String("devices", devicesFile, "Device registry file, YAML or CSV, empty for none")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bridge deadletter [flags] list | show <id> | replay [<id>...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *dir == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	store, err := bridges.OpenDeadLetters(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch cmd := flags.Arg(0); {
+	case cmd == "list":
+		return listDeadLetters(store)
+	case cmd == "show" && flags.NArg() == 2:
+		l, err := store.Get(flags.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(l)
+		return 0
+	case cmd == "replay":
+		m, err := bridges.LoadMapper(*mapper)
+		if err == nil && *devices != "" {
+			m.Devices, err = bridges.LoadRegistry(*devices)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return replayDeadLetters(store, m, flags.Args()[1:])
+	}
+	flags.Usage()
+	return 2
+}
+
+func listDeadLetters(store *bridges.DeadLetters) int {
+	letters, err := store.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tSOURCE\tSCHEMA\tERROR")
+	for _, l := range letters {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", l.ID, l.Time.Format(time.RFC3339), l.Source, l.Schema, l.Error)
+	}
+	w.Flush()
+	return 0
+}
+
+// replayDeadLetters push the dead letters ids, all of them when ids is empty, and remove the ones that succeed. It
+// return 1 if a message still fail.
+func replayDeadLetters(store *bridges.DeadLetters, m *bridges.Mapper, ids []string) int {
+	var letters []*bridges.DeadLetter
+	if len(ids) == 0 {
+		var err error
+		if letters, err = store.List(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	for _, id := range ids {
+		l, err := store.Get(id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		letters = append(letters, l)
+	}
+	ctx := apex.Stdout()
+	broker := newBrokerClient()
+	code := 0
+	for _, l := range letters {
+		if err := l.Replay(ctx, m, broker); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", l.ID, err)
+			code = 1
+			continue
+		}
+		if err := store.Remove(l.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: replayed but not removed: %s\n", l.ID, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: replayed\n", l.ID)
+	}
+	return code
+}
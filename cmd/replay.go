@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"ngsi-bridge"
+	"os"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log/apex"
+)
+
+// replay push the archived messages received between -from and -to to the broker, converted with their schema or
+// the -schema one. It return the process exit code: 1 if a message failed.
+func replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dir := flags.String("archive", archiveDir, "Archive directory")
+	from := flags.String("from", "", "Start of the time range, RFC 3339 like 2019-01-16T00:00:00Z")
+	to := flags.String("to", "", "End of the time range, excluded, now by default")
+	schema := flags.String("schema", "", "Schema key used to convert the messages, the one they were received for by default")
+	broker := flags.String("broker", brokerURL, "Fiware broker url")
+	mapper := flags.String("mapper", mapperFile, "message mapper configuration")
+	devices := flags.String("devices", devicesFile, "Device registry file, YAML or CSV, empty for none")
+	flags.Parse(args)
+
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *dir == "" || *from == "" {
+		flags.Usage()
+		return 2
+	}
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		return fail(fmt.Errorf("invalid -from: %s", err))
+	}
+	end := time.Now()
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fail(fmt.Errorf("invalid -to: %s", err))
+		}
+	}
+	m, err := bridges.LoadMapper(*mapper)
+	if err != nil {
+		return fail(err)
+	}
+	if *devices != "" {
+		if m.Devices, err = bridges.LoadRegistry(*devices); err != nil {
+			return fail(err)
+		}
+	}
+	brokerURL = *broker
+	client := newBrokerClient()
+	ctx := apex.Stdout()
+	replayed, failed := 0, 0
+	err = bridges.ReadArchive(*dir, start, end, func(r *bridges.ArchiveRecord) error {
+		if err := r.Replay(ctx, m, client, *schema); err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", r.Time.Format(time.RFC3339Nano), r.Schema, err)
+			failed++
+			return nil
+		}
+		replayed++
+		return nil
+	})
+	fmt.Printf("%d messages replayed, %d failed\n", replayed, failed)
+	if err != nil {
+		return fail(err)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"ngsi-bridge"
+	"os"
+
+	"github.com/TheThingsNetwork/go-utils/log/apex"
+)
+
+// simulate convert a message read on stdin with a schema and print the NGSI entity that would be sent to the
+// broker, or the error as JSON. It return the process exit code.
+func simulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	schema := flags.String("schema", "particle", "Schema key used to convert the message")
+	mapper := flags.String("mapper", mapperFile, "message mapper configuration")
+	devices := flags.String("devices", devicesFile, "Device registry file, YAML or CSV, empty for none")
+	flags.Parse(args)
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	fail := func(err error) int {
+		out.Encode(map[string]string{"error": err.Error(), "schema": *schema})
+		return 1
+	}
+	m, err := bridges.LoadMapper(*mapper)
+	if err != nil {
+		return fail(err)
+	}
+	if *devices != "" {
+		if m.Devices, err = bridges.LoadRegistry(*devices); err != nil {
+			return fail(err)
+		}
+	}
+	body, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fail(fmt.Errorf("could not read message: %s", err))
+	}
+	ents, err := bridges.Convert(apex.Stdout(), m, *schema, body)
+	if err != nil {
+		return fail(err)
+	}
+	sch, _ := m.Get(*schema)
+	out.Encode(bridges.Output(sch, ents))
+	return 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"ngsi-bridge"
+	"os"
+)
+
+// validate check the mapper files given as arguments, or the -mapper file, and print their diagnostics. It return
+// the process exit code: 1 if a file has errors or can't be read.
+func validate(files []string) int {
+	if len(files) == 0 {
+		files = []string{mapperFile}
+	}
+	code := 0
+	for _, file := range files {
+		buff, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		_, diags := bridges.ParseSchemas(buff)
+		for _, d := range diags {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", file, d)
+		}
+		if diags.HasErrors() {
+			code = 1
+		}
+	}
+	return code
+}
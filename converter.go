@@ -1,66 +1,187 @@
 package bridges
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
 	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
 )
 
-func decode(msg map[string]interface{}, sch *Schema) (*ngsi.Entity, error) {
+// defaultType is the entity type of the schemas without type.
+const defaultType = "WaterTank"
+
+// structuredValue is the NGSI type of the object and array attributes.
+const structuredValue = "StructuredValue"
+
+// now is replaced by the tests to get reproducible timestamps.
+var now = time.Now
+
+// parseMessage read a message body. Particle webhooks may send the event as a data= form value with escaped quotes,
+// it is unescaped when the body is not valid JSON.
+func parseMessage(buff []byte) (map[string]interface{}, error) {
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(buff, &msg); err == nil {
+		return msg, nil
+	}
+	buff = bytes.Replace(buff, []byte{'\\', '"'}, []byte{'"'}, -1)
+	buff = bytes.Replace(buff, []byte("data="), []byte(""), 1)
+	msg = make(map[string]interface{})
+	if err := json.Unmarshal(buff, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Convert decode a message body with the schema registered for key, without sending it to the broker. The entity of
+// the message is followed by the entities of its children when the schema split it.
+func Convert(ctx log.Interface, mapper *Mapper, key string, body []byte) ([]*ngsi.Entity, error) {
+	sch, ok := mapper.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("no schema found for %s", key)
+	}
+	msg, err := parseMessage(body)
+	if err != nil {
+		return nil, fmt.Errorf("message can not be parsed: %s", err)
+	}
+	return decode(ctx, msg, sch, mapper.Devices)
+}
+
+// Output return the entities converted with sch as they are shown to users: the entity alone, or all the entities
+// when the schema split messages.
+func Output(sch *Schema, ents []*ngsi.Entity) interface{} {
+	if sch.Split == nil && len(ents) == 1 {
+		return ents[0]
+	}
+	return ents
+}
+
+// decode convert a message to its entity, followed by the entities of its children when the schema split it.
+func decode(ctx log.Interface, msg map[string]interface{}, sch *Schema, devices *Registry) ([]*ngsi.Entity, error) {
 	var err error
-	if field := sch.Data.Field; field != "" {
-		if msg, err = dataField(msg, field); err != nil {
+	if sch.Data.Field != "" {
+		if msg, err = dataField(msg, sch.Data); err != nil {
 			return nil, err
 		}
 	}
-	msg = replaceField(msg, sch.Replace)
+	msg = replaceField(msg, sch)
 
-	id, err := findID(msg)
+	id, err := findID(msg, sch.ID)
 	if err != nil {
 		return nil, err
 	}
+	typ := sch.Type
+	if typ == "" {
+		typ = defaultType
+	}
+	ent, err := entity(ctx, msg, sch, id, typ, devices)
+	if err != nil {
+		return nil, err
+	}
+	ents := []*ngsi.Entity{ent}
+	if sch.Split != nil {
+		children, err := split(ctx, msg, sch, ent, devices)
+		if err != nil {
+			return nil, err
+		}
+		ents = append(ents, children...)
+	}
+	return ents, nil
+}
 
+// entity build the entity id with the attributes of the schema found in the message and the static attributes of the
+// device.
+func entity(ctx log.Interface, msg map[string]interface{}, sch *Schema, id, typ string, devices *Registry) (*ngsi.Entity, error) {
+	dev, _ := devices.Get(id)
 	attrs := make(map[string]ngsi.Attribute)
 	for k, t := range sch.Attrs {
-		if v, ok := msg[k]; ok {
-			attrs[k] = ngsi.Attribute{
-				AttrPair: ngsi.AttrPair{
-					Value: v,
-					Type:  t,
-				},
+		name, v, ok := k, msg[k], false
+		if isSelector(k) {
+			if sel := sch.selector(k); sel != nil {
+				name = sel.name()
+				v, ok = sel.find(msg)
 			}
+		} else {
+			_, ok = msg[k]
+		}
+		if ok {
+			attrs[name] = attribute(v, t)
 		}
 	}
+	compute(ctx.WithField("id", id), attrs, msg, sch, sch.params(id, dev))
+	if dev != nil {
+		dev.apply(attrs)
+	}
 	attrs["timestamp"] = ngsi.Attribute{
 		AttrPair: ngsi.AttrPair{
 			Type:  "time",
-			Value: time.Now().UTC(),
+			Value: now().UTC(),
 		},
 	}
 	return &ngsi.Entity{
-		Type:       "WaterTank",
+		Type:       typ,
 		Id:         id,
 		Attributes: attrs,
 	}, nil
 }
 
-func findID(msg map[string]interface{}) (string, error) {
-	iid, ok := msg["id"]
+// compute add the computed attributes of the schema to attrs. An attribute whose expression use a missing field or
+// parameter is left out, like the attributes missing from the message. An attribute that can't be computed, or
+// whose result is not a finite number, is left out with a warning so the other attributes are still pushed.
+func compute(ctx log.Interface, attrs map[string]ngsi.Attribute, msg map[string]interface{}, sch *Schema, params map[string]interface{}) {
+	if len(sch.exprs) == 0 {
+		return
+	}
+	env := exprEnv{fields: msg, params: params}
+	for name, e := range sch.exprs {
+		v, err := e.eval(env)
+		if err == errMissing {
+			continue
+		}
+		if f, ok := v.(float64); err == nil && ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			err = fmt.Errorf("result is %v", f)
+		}
+		if err != nil {
+			ctx.WithError(err).WithField("attr", name).Warn("Could not compute attribute, left out.")
+			continue
+		}
+		attrs[name] = attribute(v, sch.Attrs[name])
+	}
+}
+
+// findID return the entity id read in the field of the message, id by default.
+func findID(msg map[string]interface{}, field string) (string, error) {
+	if field == "" {
+		field = "id"
+	}
+	iid, ok := msg[field]
 	if !ok {
-		return "", fmt.Errorf("could not find id field")
+		return "", fmt.Errorf("could not find %s field", field)
 	}
 	id, ok := iid.(string)
 	if !ok {
-		return "", fmt.Errorf("id field could not be converted to string")
+		return "", fmt.Errorf("%s field could not be converted to string", field)
 	}
 	return id, nil
 }
 
-func replaceField(msg map[string]interface{}, keys map[string]string) map[string]interface{} {
-	for key, rKey := range keys {
+// replaceField rename the fields of the message, Replace mapping the new name to the original one. A field selected
+// by a selector is copied to the top level and kept in place.
+func replaceField(msg map[string]interface{}, sch *Schema) map[string]interface{} {
+	for key, rKey := range sch.Replace {
+		if isSelector(rKey) {
+			if sel := sch.selector(rKey); sel != nil {
+				if val, ok := sel.find(msg); ok {
+					msg[key] = val
+				}
+			}
+			continue
+		}
 		if val, ok := msg[rKey]; ok {
 			msg[key] = val
 			delete(msg, rKey)
@@ -69,23 +190,55 @@ func replaceField(msg map[string]interface{}, keys map[string]string) map[string
 	return msg
 }
 
-func dataField(msg map[string]interface{}, field string) (map[string]interface{}, error) {
-	data := msg
-	split := strings.Split(field, ".")
+// attribute return the attribute of a value. Objects and arrays are StructuredValue attributes, the type of the
+// schema is kept as their unit metadata.
+func attribute(v interface{}, typ string) ngsi.Attribute {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		if typ != structuredValue {
+			return ngsi.Attribute{
+				AttrPair: ngsi.AttrPair{Value: v, Type: structuredValue},
+				Metadata: map[string]ngsi.AttrPair{"unit": {Value: typ, Type: "Text"}},
+			}
+		}
+	}
+	return ngsi.Attribute{
+		AttrPair: ngsi.AttrPair{
+			Value: v,
+			Type:  typ,
+		},
+	}
+}
+
+// dataField replace the message by the content of the data field decoded with the data format. The other top level
+// fields of the message are kept.
+func dataField(msg map[string]interface{}, opts SchemaData) (map[string]interface{}, error) {
+	format, err := parseFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	split := strings.Split(opts.Field, ".")
+	var tmp interface{} = msg
 	for _, str := range split {
-		tmp, ok := data[str]
+		if enc, ok := tmp.(string); ok {
+			// A nested object may itself be encoded as a JSON string.
+			parent := make(map[string]interface{})
+			if err := json.Unmarshal([]byte(enc), &parent); err == nil {
+				tmp = parent
+			}
+		}
+		parent, ok := tmp.(map[string]interface{})
 		if !ok {
-			return nil, fmt.Errorf("could not find field %s", field)
+			return nil, fmt.Errorf("could not find field %s", opts.Field)
 		}
-		switch tmp.(type) {
-		case string:
-			return nil, json.Unmarshal([]byte(tmp.(string)), &msg)
-		case map[string]interface{}:
-			data = tmp.(map[string]interface{})
-		default:
-			return nil, fmt.Errorf("unsupported field type %T", tmp)
+		if tmp, ok = parent[str]; !ok {
+			return nil, fmt.Errorf("could not find field %s", opts.Field)
 		}
 	}
+	data, err := format.decode(tmp, opts)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %s", opts.Field, err)
+	}
 	delete(msg, split[0])
 	for key, val := range msg {
 		data[key] = val
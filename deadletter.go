@@ -0,0 +1,124 @@
+package bridges
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// deadLetterCount count the messages written to the dead-letter store by source.
+var deadLetterCount = expvar.NewMap("dead_letters")
+
+// DeadLetter is a message that could not be converted or pushed to the broker, with the schema key used to convert
+// it and the error.
+type DeadLetter struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Schema string    `json:"schema"`
+	Error  string    `json:"error"`
+	Body   string    `json:"body"`
+}
+
+// Replay convert the message again, with the current schemas, and push it to the broker timestamped when it failed.
+func (l *DeadLetter) Replay(ctx log.Interface, mapper *Mapper, broker *ngsi.Client) error {
+	return replay(ctx, mapper, broker, l.Schema, []byte(l.Body), l.Time)
+}
+
+// DeadLetters store the dead letters in a directory, a JSON file each.
+type DeadLetters struct {
+	dir string
+	seq uint64
+}
+
+// OpenDeadLetters return the store of the directory dir, creating it if needed.
+func OpenDeadLetters(dir string) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DeadLetters{dir: dir}, nil
+}
+
+// Add write a dead letter for the message body from source, like http or ttn, that failed with err. A nil store
+// drop it.
+func (d *DeadLetters) Add(source, key string, body []byte, err error) error {
+	if d == nil {
+		return nil
+	}
+	at := now().UTC()
+	l := &DeadLetter{
+		ID:     fmt.Sprintf("%s-%d", at.Format("20060102T150405.000000000"), atomic.AddUint64(&d.seq, 1)),
+		Time:   at,
+		Source: source,
+		Schema: key,
+		Error:  err.Error(),
+		Body:   string(body),
+	}
+	buff, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(d.file(l.ID), buff, 0644); err != nil {
+		return err
+	}
+	deadLetterCount.Add(source, 1)
+	return nil
+}
+
+// List return the dead letters, oldest first.
+func (d *DeadLetters) List() ([]*DeadLetter, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var letters []*DeadLetter
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		l, err := d.Get(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	return letters, nil
+}
+
+// Get return the dead letter id.
+func (d *DeadLetters) Get(id string) (*DeadLetter, error) {
+	if strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid dead letter id %s", id)
+	}
+	buff, err := ioutil.ReadFile(d.file(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no dead letter %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &DeadLetter{}
+	if err = json.Unmarshal(buff, l); err != nil {
+		return nil, fmt.Errorf("invalid dead letter %s: %s", id, err)
+	}
+	return l, nil
+}
+
+// Remove delete the dead letter id, once it was replayed.
+func (d *DeadLetters) Remove(id string) error {
+	return os.Remove(d.file(id))
+}
+
+func (d *DeadLetters) file(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
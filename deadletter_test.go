@@ -0,0 +1,53 @@
+package bridges
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestDeadLetters(t *testing.T) {
+	a := assertions.New(t)
+	dir, err := ioutil.TempDir("", "deadletters")
+	a.So(err, assertions.ShouldBeNil)
+	defer os.RemoveAll(dir)
+
+	var nilStore *DeadLetters
+	a.So(nilStore.Add("http", "tank", nil, errors.New("failed")), assertions.ShouldBeNil)
+	d, err := OpenDeadLetters(dir)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(d.Add("http", "tank", []byte(`{"id": "tank-1", "level": 10}`), errors.New("no schema found for tank")), assertions.ShouldBeNil)
+	a.So(d.Add("ttn", "ttn", []byte(`{`), errors.New("unexpected end of JSON input")), assertions.ShouldBeNil)
+	letters, err := d.List()
+	a.So(err, assertions.ShouldBeNil)
+	a.So(letters, assertions.ShouldHaveLength, 2)
+	a.So(letters[0].Schema, assertions.ShouldEqual, "tank")
+	a.So(letters[0].Error, assertions.ShouldEqual, "no schema found for tank")
+	a.So(letters[1].Source, assertions.ShouldEqual, "ttn")
+	_, err = d.Get("../tank")
+	a.So(err, assertions.ShouldNotBeNil)
+
+	var pushed int
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer broker.Close()
+	client := ngsi.NewClient(broker.URL)
+	mapper := NewMapper(map[string]*Schema{"tank": {Attrs: map[string]string{"level": "liters"}}})
+	a.So(letters[0].Replay(log.Get(), mapper, client), assertions.ShouldBeNil)
+	a.So(pushed, assertions.ShouldEqual, 1)
+	a.So(letters[1].Replay(log.Get(), mapper, client), assertions.ShouldNotBeNil)
+	a.So(d.Remove(letters[0].ID), assertions.ShouldBeNil)
+	letters, err = d.List()
+	a.So(err, assertions.ShouldBeNil)
+	a.So(letters, assertions.ShouldHaveLength, 1)
+}
@@ -0,0 +1,141 @@
+package bridges
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDedupWindow is how long a message is remembered when the schema doesn't set a window.
+const defaultDedupWindow = time.Minute
+
+// maxDedupEntries limit the memory used by a Deduplicator, the oldest fingerprints are forgotten first.
+const maxDedupEntries = 100000
+
+// duplicates count the dropped duplicate messages by schema key.
+var duplicates = expvar.NewMap("dedup_duplicates")
+
+// SchemaDedup drop the copies of a message received within Window, like 30s, one minute by default. Messages are
+// identified by the values of Fields, like dev_id and counter for TTN uplinks, by the Header of the HTTP request
+// carrying a message ID, or else by a hash of the payload.
+type SchemaDedup struct {
+	Fields []string `json:"fields,omitempty" yaml:",omitempty"`
+	Header string   `json:"header,omitempty" yaml:",omitempty"`
+	Window string   `json:"window,omitempty" yaml:",omitempty"`
+}
+
+func (d *SchemaDedup) window() time.Duration {
+	if w, err := time.ParseDuration(d.Window); err == nil {
+		return w
+	}
+	return defaultDedupWindow
+}
+
+// check return the problems of the dedup settings.
+func (d *SchemaDedup) check() []pathDiagnostic {
+	var diags []pathDiagnostic
+	if d.Window != "" {
+		if w, err := time.ParseDuration(d.Window); err != nil || w <= 0 {
+			diags = append(diags, errorAt(fmt.Sprintf("invalid dedup window %q", d.Window), "dedup", "window"))
+		}
+	}
+	for _, field := range d.Fields {
+		if _, err := parseSelector(field); err != nil {
+			diags = append(diags, errorAt(err.Error(), "dedup", "fields"))
+		}
+	}
+	return diags
+}
+
+// fingerprint identify a message. header return the header of the request, nil when the message wasn't received by
+// HTTP, and payload is hashed when the message has no field or header identifying it.
+func (d *SchemaDedup) fingerprint(msg map[string]interface{}, header func(string) string, payload []byte) string {
+	if d.Header != "" && header != nil {
+		if id := header(d.Header); id != "" {
+			return "header:" + id
+		}
+	}
+	if len(d.Fields) > 0 {
+		values := make([]string, 0, len(d.Fields))
+		for _, field := range d.Fields {
+			sel, err := parseSelector(field)
+			if err != nil {
+				continue
+			}
+			if v, ok := sel.find(msg); ok {
+				values = append(values, fmt.Sprint(v))
+			}
+		}
+		if len(values) == len(d.Fields) {
+			return "fields:" + strings.Join(values, "\x00")
+		}
+	}
+	sum := sha256.Sum256(payload)
+	return "hash:" + hex.EncodeToString(sum[:])
+}
+
+// Deduplicator remember the fingerprints of the messages received recently.
+type Deduplicator struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	queue []dedupEntry
+}
+
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+// NewDeduplicator return an empty Deduplicator.
+func NewDeduplicator() *Deduplicator {
+	return &Deduplicator{seen: map[string]time.Time{}}
+}
+
+// Duplicate tell if the message was already received with the schema key within the dedup window, and remember it
+// otherwise. Duplicates are counted. It return the fingerprint of the message, to Forget it when it could not be
+// pushed so its retry isn't dropped.
+func (d *Deduplicator) Duplicate(key string, sch *Schema, msg map[string]interface{}, header func(string) string, payload []byte) (string, bool) {
+	if d == nil || sch.Dedup == nil {
+		return "", false
+	}
+	fp := key + "\x00" + sch.Dedup.fingerprint(msg, header, payload)
+	at := now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(at)
+	if until, ok := d.seen[fp]; ok && at.Before(until) {
+		duplicates.Add(key, 1)
+		return fp, true
+	}
+	until := at.Add(sch.Dedup.window())
+	d.seen[fp] = until
+	d.queue = append(d.queue, dedupEntry{fp, until})
+	return fp, false
+}
+
+// Forget the fingerprint of a message returned by Duplicate, its next copy is handled.
+func (d *Deduplicator) Forget(fp string) {
+	if d == nil || fp == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, fp)
+}
+
+// expire forget the fingerprints whose window is over, and the oldest ones when there are too many. Windows of
+// different schemas can differ so an entry is only forgotten if it wasn't seen again since.
+func (d *Deduplicator) expire(at time.Time) {
+	n := 0
+	for n < len(d.queue) && (!at.Before(d.queue[n].at) || len(d.queue)-n > maxDedupEntries) {
+		if e := d.queue[n]; d.seen[e.key].Equal(e.at) {
+			delete(d.seen, e.key)
+		}
+		n++
+	}
+	d.queue = d.queue[n:]
+}
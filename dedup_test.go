@@ -0,0 +1,50 @@
+package bridges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestDeduplicator(t *testing.T) {
+	a := assertions.New(t)
+	at := time.Date(2019, 1, 16, 16, 0, 0, 0, time.UTC)
+	now = func() time.Time { return at }
+	defer func() { now = time.Now }()
+
+	d := NewDeduplicator()
+	dup := func(key string, sch *Schema, msg map[string]interface{}, header func(string) string, payload []byte) bool {
+		_, ok := d.Duplicate(key, sch, msg, header, payload)
+		return ok
+	}
+	sch := &Schema{Dedup: &SchemaDedup{Fields: []string{"dev_id", "counter"}, Window: "1m"}}
+	up := func(counter float64) map[string]interface{} {
+		return map[string]interface{}{"dev_id": "tank-7", "counter": counter}
+	}
+	a.So(dup("ttn", &Schema{}, up(1), nil, nil), assertions.ShouldBeFalse)
+	a.So(dup("ttn", sch, up(1), nil, nil), assertions.ShouldBeFalse)
+	a.So(dup("ttn", sch, up(1), nil, nil), assertions.ShouldBeTrue)
+	a.So(dup("ttn", sch, up(2), nil, nil), assertions.ShouldBeFalse)
+	a.So(dup("other", sch, up(1), nil, nil), assertions.ShouldBeFalse)
+	at = at.Add(time.Minute)
+	a.So(dup("ttn", sch, up(1), nil, nil), assertions.ShouldBeFalse)
+	a.So(d.seen, assertions.ShouldHaveLength, 1)
+	fp, _ := d.Duplicate("ttn", sch, up(3), nil, nil)
+	d.Forget(fp)
+	a.So(dup("ttn", sch, up(3), nil, nil), assertions.ShouldBeFalse)
+	a.So(dup("ttn", sch, up(3), nil, nil), assertions.ShouldBeTrue)
+
+	header := func(id string) func(string) string {
+		return func(string) string { return id }
+	}
+	sch.Dedup = &SchemaDedup{Header: "X-Request-Id"}
+	a.So(dup("particle", sch, nil, header("a"), []byte("x")), assertions.ShouldBeFalse)
+	a.So(dup("particle", sch, nil, header("a"), []byte("y")), assertions.ShouldBeTrue)
+	a.So(dup("particle", sch, nil, header("b"), []byte("x")), assertions.ShouldBeFalse)
+	a.So(dup("particle", sch, nil, header(""), []byte("x")), assertions.ShouldBeFalse)
+	a.So(dup("particle", sch, nil, nil, []byte("x")), assertions.ShouldBeTrue)
+
+	a.So((&SchemaDedup{Window: "soon"}).check(), assertions.ShouldHaveLength, 1)
+	a.So((&SchemaDedup{Fields: []string{"a["}}).check(), assertions.ShouldHaveLength, 1)
+}
@@ -0,0 +1,187 @@
+package bridges
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Overflow is what a Dispatcher do with a message when the queue of its worker is full.
+type Overflow string
+
+// Overflow policies: wait for room in the queue, drop the oldest queued message or reject the new one.
+const (
+	OverflowBlock      Overflow = "block"
+	OverflowDropOldest Overflow = "drop-oldest"
+	OverflowReject     Overflow = "reject"
+)
+
+var (
+	// ErrQueueFull is returned for the messages rejected because the queue is full.
+	ErrQueueFull = errors.New("dispatch queue is full")
+	// ErrDropped is returned for the queued messages dropped to make room for newer ones.
+	ErrDropped = errors.New("message dropped from a full dispatch queue")
+	// ErrClosed is returned for the messages dispatched after Close.
+	ErrClosed = errors.New("dispatcher is closed")
+)
+
+// dispatchMetrics count the messages dispatched, dropped and rejected.
+var dispatchMetrics = expvar.NewMap("dispatch")
+
+// ParseOverflow return the overflow policy named s.
+func ParseOverflow(s string) (Overflow, error) {
+	switch o := Overflow(s); o {
+	case OverflowBlock, OverflowDropOldest, OverflowReject:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q, use block, drop-oldest or reject", s)
+}
+
+// Dispatcher push the messages of the bridges with a pool of workers. The messages of an entity always go to the same
+// worker so they are pushed in order, while different entities are pushed in parallel. Each worker has a bounded
+// queue, Overflow tell what happen when it is full.
+type Dispatcher struct {
+	overflow Overflow
+	queues   []chan *job
+	mu       sync.RWMutex
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type job struct {
+	run  func() error
+	done chan error
+}
+
+// finish send the result of the job to the one waiting for it, if any.
+func (j *job) finish(err error) {
+	if j.done != nil {
+		j.done <- err
+	}
+}
+
+// NewDispatcher start workers, each with a queue of size messages.
+func NewDispatcher(workers, size int, overflow Overflow) (*Dispatcher, error) {
+	if workers < 1 || size < 1 {
+		return nil, fmt.Errorf("dispatcher needs at least a worker and a queue of one message")
+	}
+	if _, err := ParseOverflow(string(overflow)); err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{overflow: overflow, queues: make([]chan *job, workers)}
+	for i := range d.queues {
+		d.queues[i] = make(chan *job, size)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d, nil
+}
+
+func (d *Dispatcher) work(queue chan *job) {
+	defer d.wg.Done()
+	for j := range queue {
+		j.finish(j.run())
+	}
+}
+
+// Do run fn on the worker of the entity id and wait for its result. A nil dispatcher run fn directly.
+func (d *Dispatcher) Do(id string, fn func() error) error {
+	if d == nil {
+		return fn()
+	}
+	j := &job{run: fn, done: make(chan error, 1)}
+	if err := d.submit(id, j); err != nil {
+		return err
+	}
+	return <-j.done
+}
+
+// Go queue fn on the worker of the entity id without waiting for it, fn must handle its errors. A nil dispatcher run
+// fn directly.
+func (d *Dispatcher) Go(id string, fn func()) error {
+	run := func() error {
+		fn()
+		return nil
+	}
+	if d == nil {
+		return run()
+	}
+	return d.submit(id, &job{run: run})
+}
+
+func (d *Dispatcher) submit(id string, j *job) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	queue := d.queues[h.Sum32()%uint32(len(d.queues))]
+	dispatchMetrics.Add("dispatched", 1)
+	switch d.overflow {
+	case OverflowReject:
+		select {
+		case queue <- j:
+		default:
+			dispatchMetrics.Add("rejected", 1)
+			return ErrQueueFull
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- j:
+				return nil
+			default:
+			}
+			// The worker may have taken the oldest message meanwhile, then there is room on the next try.
+			select {
+			case old := <-queue:
+				dispatchMetrics.Add("dropped", 1)
+				old.finish(ErrDropped)
+			default:
+			}
+		}
+	default:
+		queue <- j
+	}
+	return nil
+}
+
+// Pending return the number of messages waiting in the queues.
+func (d *Dispatcher) Pending() int {
+	if d == nil {
+		return 0
+	}
+	n := 0
+	for _, queue := range d.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Capacity return the number of messages the queues can hold.
+func (d *Dispatcher) Capacity() int {
+	if d == nil {
+		return 0
+	}
+	return len(d.queues) * cap(d.queues[0])
+}
+
+// Close stop accepting messages and wait for the queued ones to be pushed.
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
@@ -0,0 +1,77 @@
+package bridges
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestDispatcher_Order(t *testing.T) {
+	a := assertions.New(t)
+	d, err := NewDispatcher(4, 10, OverflowBlock)
+	a.So(err, assertions.ShouldBeNil)
+	var mu sync.Mutex
+	got := map[string][]int{}
+	for i := 0; i < 100; i++ {
+		id, i := fmt.Sprintf("tank-%d", i%5), i
+		a.So(d.Go(id, func() {
+			mu.Lock()
+			got[id] = append(got[id], i)
+			mu.Unlock()
+		}), assertions.ShouldBeNil)
+	}
+	d.Close()
+	for id, seq := range got {
+		a.So(seq, assertions.ShouldHaveLength, 20)
+		for i := 1; i < len(seq); i++ {
+			a.So(seq[i], assertions.ShouldBeGreaterThan, seq[i-1])
+		}
+		a.So(id, assertions.ShouldStartWith, "tank-")
+	}
+	a.So(d.Go("tank-0", func() {}), assertions.ShouldEqual, ErrClosed)
+
+	var nilDispatcher *Dispatcher
+	a.So(nilDispatcher.Do("tank", func() error { return errors.New("failed") }), assertions.ShouldBeError, "failed")
+	_, err = NewDispatcher(1, 1, "later")
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestDispatcher_Overflow(t *testing.T) {
+	a := assertions.New(t)
+	for _, tc := range []struct {
+		overflow Overflow
+		err      error
+	}{
+		{OverflowReject, ErrQueueFull},
+		{OverflowDropOldest, ErrDropped},
+	} {
+		d, err := NewDispatcher(1, 1, tc.overflow)
+		a.So(err, assertions.ShouldBeNil)
+		started, release := make(chan struct{}), make(chan struct{})
+		d.Go("tank", func() {
+			close(started)
+			<-release
+		})
+		<-started
+		// Queued synchronously so the queue is full before the last message.
+		queued := &job{run: func() error { return nil }, done: make(chan error, 1)}
+		a.So(d.submit("tank", queued), assertions.ShouldBeNil)
+		last := make(chan error, 1)
+		go func() {
+			last <- d.Do("tank", func() error { return nil })
+		}()
+		if tc.overflow == OverflowReject {
+			a.So(<-last, assertions.ShouldEqual, ErrQueueFull)
+			close(release)
+			a.So(<-queued.done, assertions.ShouldBeNil)
+		} else {
+			a.So(<-queued.done, assertions.ShouldEqual, ErrDropped)
+			close(release)
+			a.So(<-last, assertions.ShouldBeNil)
+		}
+		d.Close()
+	}
+}
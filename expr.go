@@ -0,0 +1,571 @@
+package bridges
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expressions compute attributes from the fields of a message and the static parameters of the device. They are made
+// of numbers, 'strings', true and false, fields like level or data.level, parameters like params.height, the
+// operators + - * / % == != < <= > >= && || ! and c ? a : b, and the functions of exprFuncs. They have no loop and no
+// side effect, so evaluating them is always safe.
+
+// maxExprDepth limit the nesting of an expression.
+const maxExprDepth = 64
+
+// paramsPrefix start the names of the static parameters in expressions.
+const paramsPrefix = "params."
+
+// errMissing is returned when an expression use a field or a parameter that is not set.
+var errMissing = errors.New("missing value")
+
+// exprType is the type of an expression, anyType when it depend on a field.
+type exprType int
+
+const (
+	anyType exprType = iota
+	numberType
+	stringType
+	boolType
+)
+
+func (t exprType) String() string {
+	return [...]string{"any", "number", "string", "bool"}[t]
+}
+
+// exprEnv hold the values an expression can use.
+type exprEnv struct {
+	fields map[string]interface{}
+	params map[string]interface{}
+}
+
+type expr interface {
+	eval(env exprEnv) (interface{}, error)
+}
+
+// compileExpr parse an expression and check the types of its operands.
+func compileExpr(src string) (expr, error) {
+	p := &exprParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	e, _, err := p.parse(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return e, nil
+}
+
+// exprFunc is a function usable in expressions. Its arguments are numbers, a negative arity means at least -arity
+// arguments.
+type exprFunc struct {
+	arity int
+	fn    func(args []float64) float64
+}
+
+var exprFuncs = map[string]exprFunc{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min": {-2, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	"max": {-2, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+}
+
+// binaryOps give the precedence of the binary operators, ? having the lowest one.
+var binaryOps = map[string]int{
+	"?":  1,
+	"||": 2,
+	"&&": 3,
+	"==": 4, "!=": 4,
+	"<": 5, "<=": 5, ">": 5, ">=": 5,
+	"+": 6, "-": 6,
+	"*": 7, "/": 7, "%": 7,
+}
+
+type exprParser struct {
+	src  string
+	pos  int
+	tok  string
+	kind byte // n for numbers, s for strings, i for identifiers, o for operators
+	at   int
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", p.at+1, fmt.Sprintf(format, args...))
+}
+
+// next read the next token, tok is empty at the end of the expression.
+func (p *exprParser) next() error {
+	for p.pos < len(p.src) && strings.ContainsRune(" \t\n\r", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	p.at = p.pos
+	if p.pos == len(p.src) {
+		p.tok, p.kind = "", 0
+		return nil
+	}
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		end := p.pos
+		for end < len(p.src) && (strings.IndexByte("0123456789.eE", p.src[end]) >= 0 ||
+			(p.src[end] == '-' || p.src[end] == '+') && (p.src[end-1] == 'e' || p.src[end-1] == 'E')) {
+			end++
+		}
+		p.tok, p.kind = p.src[p.pos:end], 'n'
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		end := p.pos
+		for end < len(p.src) && (p.src[end] == '_' || p.src[end] == '.' || p.src[end] >= 'a' && p.src[end] <= 'z' ||
+			p.src[end] >= 'A' && p.src[end] <= 'Z' || p.src[end] >= '0' && p.src[end] <= '9') {
+			end++
+		}
+		p.tok, p.kind = p.src[p.pos:end], 'i'
+	case c == '\'' || c == '"':
+		end := strings.IndexByte(p.src[p.pos+1:], c)
+		if end < 0 {
+			return p.errorf("unterminated string")
+		}
+		p.tok, p.kind = p.src[p.pos+1:p.pos+1+end], 's'
+		p.pos += end + 2
+		return nil
+	default:
+		p.tok, p.kind = string(c), 'o'
+		if p.pos+1 < len(p.src) {
+			switch two := p.src[p.pos : p.pos+2]; two {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				p.tok = two
+			}
+		}
+		if len(p.tok) == 1 && !strings.Contains("+-*/%()<>!?:,", p.tok) {
+			return p.errorf("unexpected character %q", c)
+		}
+	}
+	p.pos += len(p.tok)
+	return nil
+}
+
+// parse read an expression whose binary operators have a precedence above min.
+func (p *exprParser) parse(min, depth int) (expr, exprType, error) {
+	if depth > maxExprDepth {
+		return nil, anyType, p.errorf("expression too deeply nested")
+	}
+	x, xt, err := p.operand(depth)
+	if err != nil {
+		return nil, anyType, err
+	}
+	for {
+		op := p.tok
+		prec, ok := binaryOps[op]
+		if p.kind != 'o' || !ok || prec <= min {
+			return x, xt, nil
+		}
+		at := p.at
+		if err := p.next(); err != nil {
+			return nil, anyType, err
+		}
+		if op == "?" {
+			// The condition is right associative: a ? b : c ? d : e.
+			a, aType, err := p.parse(0, depth+1)
+			if err != nil {
+				return nil, anyType, err
+			}
+			if p.tok != ":" {
+				return nil, anyType, p.errorf("expected : after ?")
+			}
+			if err := p.next(); err != nil {
+				return nil, anyType, err
+			}
+			b, bt, err := p.parse(prec-1, depth+1)
+			if err != nil {
+				return nil, anyType, err
+			}
+			if xt != anyType && xt != boolType {
+				return nil, anyType, fmt.Errorf("column %d: condition is a %s, not a bool", at+1, xt)
+			}
+			x, xt = &condExpr{x, a, b}, aType
+			if aType != bt {
+				xt = anyType
+			}
+			continue
+		}
+		y, yt, err := p.parse(prec, depth+1)
+		if err != nil {
+			return nil, anyType, err
+		}
+		t, err := binaryType(op, xt, yt)
+		if err != nil {
+			return nil, anyType, fmt.Errorf("column %d: %s", at+1, err)
+		}
+		x, xt = &binaryExpr{op, x, y, xt, yt}, t
+	}
+}
+
+// operand read a literal, a field, a function call, a parenthesized expression or a unary operation.
+func (p *exprParser) operand(depth int) (expr, exprType, error) {
+	tok, kind, at := p.tok, p.kind, p.at
+	if tok == "" {
+		return nil, anyType, p.errorf("unexpected end of expression")
+	}
+	if err := p.next(); err != nil {
+		return nil, anyType, err
+	}
+	switch kind {
+	case 'n':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, anyType, fmt.Errorf("column %d: invalid number %s", at+1, tok)
+		}
+		return literal{v}, numberType, nil
+	case 's':
+		return literal{tok}, stringType, nil
+	case 'i':
+		switch {
+		case tok == "true" || tok == "false":
+			return literal{tok == "true"}, boolType, nil
+		case p.tok == "(":
+			return p.call(tok, at, depth)
+		case strings.HasPrefix(tok, paramsPrefix):
+			return paramExpr(strings.TrimPrefix(tok, paramsPrefix)), anyType, nil
+		}
+		return fieldExpr(strings.Split(tok, ".")), anyType, nil
+	}
+	switch tok {
+	case "(":
+		x, xt, err := p.parse(0, depth+1)
+		if err != nil {
+			return nil, anyType, err
+		}
+		if p.tok != ")" {
+			return nil, anyType, p.errorf("expected )")
+		}
+		return x, xt, p.next()
+	case "-", "!":
+		x, xt, err := p.parse(binaryOps["*"], depth+1)
+		if err != nil {
+			return nil, anyType, err
+		}
+		want := numberType
+		if tok == "!" {
+			want = boolType
+		}
+		if xt != anyType && xt != want {
+			return nil, anyType, fmt.Errorf("column %d: %s of a %s", at+1, tok, xt)
+		}
+		return &unaryExpr{tok, x}, want, nil
+	}
+	return nil, anyType, fmt.Errorf("column %d: unexpected %s", at+1, tok)
+}
+
+func (p *exprParser) call(name string, at, depth int) (expr, exprType, error) {
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, anyType, fmt.Errorf("column %d: unknown function %s", at+1, name)
+	}
+	c := &callExpr{name: name, fn: fn}
+	if err := p.next(); err != nil {
+		return nil, anyType, err
+	}
+	for p.tok != ")" {
+		if len(c.args) > 0 {
+			if p.tok != "," {
+				return nil, anyType, p.errorf("expected , or )")
+			}
+			if err := p.next(); err != nil {
+				return nil, anyType, err
+			}
+		}
+		arg, t, err := p.parse(0, depth+1)
+		if err != nil {
+			return nil, anyType, err
+		}
+		if t != anyType && t != numberType {
+			return nil, anyType, fmt.Errorf("column %d: %s argument %d is a %s, not a number", at+1, name, len(c.args)+1, t)
+		}
+		c.args = append(c.args, arg)
+	}
+	if fn.arity >= 0 && len(c.args) != fn.arity || fn.arity < 0 && len(c.args) < -fn.arity {
+		return nil, anyType, fmt.Errorf("column %d: wrong number of arguments for %s", at+1, name)
+	}
+	return c, numberType, p.next()
+}
+
+// binaryType return the type of a binary operation, or an error if the operands can't have the types of the
+// operator.
+func binaryType(op string, x, y exprType) (exprType, error) {
+	both := func(t exprType) bool {
+		return (x == t || x == anyType) && (y == t || y == anyType)
+	}
+	switch op {
+	case "==", "!=":
+		if x != anyType && y != anyType && x != y {
+			return anyType, fmt.Errorf("%s compare a %s with a %s", op, x, y)
+		}
+		return boolType, nil
+	case "&&", "||":
+		if !both(boolType) {
+			return anyType, fmt.Errorf("%s of a %s and a %s", op, x, y)
+		}
+		return boolType, nil
+	case "<", "<=", ">", ">=":
+		if !both(numberType) && !both(stringType) {
+			return anyType, fmt.Errorf("%s compare a %s with a %s", op, x, y)
+		}
+		return boolType, nil
+	case "+":
+		if x == stringType || y == stringType {
+			if !both(stringType) {
+				return anyType, fmt.Errorf("+ of a %s and a %s", x, y)
+			}
+			return stringType, nil
+		}
+		if x == anyType && y == anyType {
+			return anyType, nil
+		}
+	}
+	if !both(numberType) {
+		return anyType, fmt.Errorf("%s of a %s and a %s", op, x, y)
+	}
+	return numberType, nil
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (l literal) eval(env exprEnv) (interface{}, error) {
+	return l.v, nil
+}
+
+// fieldExpr read a field of the message, nested objects are traversed.
+type fieldExpr []string
+
+func (f fieldExpr) eval(env exprEnv) (interface{}, error) {
+	var v interface{} = env.fields
+	for _, k := range f {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errMissing
+		}
+		if v, ok = m[k]; !ok || v == nil {
+			return nil, errMissing
+		}
+	}
+	return exprValue(v)
+}
+
+type paramExpr string
+
+func (p paramExpr) eval(env exprEnv) (interface{}, error) {
+	v, ok := env.params[string(p)]
+	if !ok || v == nil {
+		return nil, errMissing
+	}
+	return exprValue(v)
+}
+
+// exprValue turn a field or parameter value into a number, a string or a bool.
+func exprValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64, string, bool:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+// number return v as a number, numeric strings like the values sent by Particle devices are converted.
+func number(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+func boolean(v interface{}) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%v is not a bool", v)
+	}
+	return b, nil
+}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+func (u *unaryExpr) eval(env exprEnv) (interface{}, error) {
+	v, err := u.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if u.op == "!" {
+		b, err := boolean(v)
+		return !b, err
+	}
+	f, err := number(v)
+	return -f, err
+}
+
+// binaryExpr is an operation on x and y, xt and yt are their types at compile time.
+type binaryExpr struct {
+	op     string
+	x, y   expr
+	xt, yt exprType
+}
+
+func (b *binaryExpr) eval(env exprEnv) (interface{}, error) {
+	x, err := b.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if b.op == "&&" || b.op == "||" {
+		xb, err := boolean(x)
+		if err != nil || xb == (b.op == "||") {
+			return xb, err
+		}
+		y, err := b.y.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		return boolean(y)
+	}
+	y, err := b.y.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	xf, yf, numbers := b.numbers(x, y)
+	switch b.op {
+	case "==":
+		return x == y || numbers && xf == yf, nil
+	case "!=":
+		return x != y && !(numbers && xf == yf), nil
+	}
+	xs, xok := x.(string)
+	ys, yok := y.(string)
+	// Two strings are concatenated, a numeric string is only added to a number.
+	if b.op == "+" && (xok && yok || (xok || yok) && !numbers) {
+		return fmt.Sprint(x) + fmt.Sprint(y), nil
+	}
+	if !numbers && xok && yok {
+		switch b.op {
+		case "<":
+			return xs < ys, nil
+		case "<=":
+			return xs <= ys, nil
+		case ">":
+			return xs > ys, nil
+		case ">=":
+			return xs >= ys, nil
+		}
+	}
+	if !numbers {
+		return nil, fmt.Errorf("%s of %v and %v", b.op, x, y)
+	}
+	switch b.op {
+	case "<":
+		return xf < yf, nil
+	case "<=":
+		return xf <= yf, nil
+	case ">":
+		return xf > yf, nil
+	case ">=":
+		return xf >= yf, nil
+	case "+":
+		return xf + yf, nil
+	case "-":
+		return xf - yf, nil
+	case "*":
+		return xf * yf, nil
+	case "/":
+		return xf / yf, nil
+	}
+	return math.Mod(xf, yf), nil
+}
+
+// numbers return the operands as numbers when they both are. The numeric strings of the fields and parameters, like
+// the values sent by Particle devices, are numbers, the strings typed at compile time are always text.
+func (b *binaryExpr) numbers(x, y interface{}) (float64, float64, bool) {
+	if b.xt == stringType || b.yt == stringType {
+		return 0, 0, false
+	}
+	xf, xerr := number(x)
+	yf, yerr := number(y)
+	return xf, yf, xerr == nil && yerr == nil
+}
+
+type condExpr struct {
+	c, a, b expr
+}
+
+func (c *condExpr) eval(env exprEnv) (interface{}, error) {
+	v, err := c.c.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := boolean(v)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return c.a.eval(env)
+	}
+	return c.b.eval(env)
+}
+
+type callExpr struct {
+	name string
+	fn   exprFunc
+	args []expr
+}
+
+func (c *callExpr) eval(env exprEnv) (interface{}, error) {
+	args := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if args[i], err = number(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.name, err)
+		}
+	}
+	return c.fn.fn(args), nil
+}
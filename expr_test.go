@@ -0,0 +1,123 @@
+package bridges
+
+import (
+	"math"
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestExpr(t *testing.T) {
+	env := exprEnv{
+		fields: map[string]interface{}{
+			"temp":     20.0,
+			"humidity": "50",
+			"small":    "9",
+			"large":    "10",
+			"name":     "tank",
+			"open":     true,
+			"data":     map[string]interface{}{"level": 1.5},
+		},
+		params: map[string]interface{}{"height": 4},
+	}
+	for _, tt := range []struct {
+		src string
+		out interface{}
+	}{
+		{"1 + 2 * 3 - 4 / 2", 5.0},
+		{"-(1 + 2) % 2", -1.0},
+		{"100 * data.level / params.height", 37.5},
+		{"humidity * 2", 100.0},
+		{"humidity + 273.15", 323.15},
+		{"small < large", true},
+		{"small + large", "910"},
+		{"small + 1", 10.0},
+		{"small == 9", true},
+		{"small == '9.0'", false},
+		{"large < '9'", true},
+		{"'1' + '2'", "12"},
+		{"'10' < '9'", true},
+		{"'1' == '1.0'", false},
+		{"name > 'abc'", true},
+		{"humidity == 50 && !open", false},
+		{"temp > 30 ? 'hot' : temp > 10 ? 'mild' : 'cold'", "mild"},
+		{"name + '-' + temp", "tank-20"},
+		{"max(1, temp, 3) + min(2, 1) + abs(-1) + pow(2, 3)", 30.0},
+		{"round(243.04 * (log(humidity / 100) + 17.625 * temp / (243.04 + temp)) / " +
+			"(17.625 - log(humidity / 100) - 17.625 * temp / (243.04 + temp)))", 9.0},
+		{"1.5e1", 15.0},
+	} {
+		a := assertions.New(t)
+		e, err := compileExpr(tt.src)
+		a.So(err, assertions.ShouldBeNil)
+		if err != nil {
+			continue
+		}
+		out, err := e.eval(env)
+		a.So(err, assertions.ShouldBeNil)
+		a.So(out, assertions.ShouldEqual, tt.out)
+	}
+
+	a := assertions.New(t)
+	e, err := compileExpr("missing + params.width")
+	a.So(err, assertions.ShouldBeNil)
+	_, err = e.eval(env)
+	a.So(err, assertions.ShouldEqual, errMissing)
+	e, err = compileExpr("name * 2")
+	a.So(err, assertions.ShouldBeNil)
+	_, err = e.eval(env)
+	a.So(err, assertions.ShouldNotBeNil)
+	e, err = compileExpr("temp / 0")
+	a.So(err, assertions.ShouldBeNil)
+	out, err := e.eval(env)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(math.IsInf(out.(float64), 1), assertions.ShouldBeTrue)
+}
+
+func TestExprErrors(t *testing.T) {
+	for src, msg := range map[string]string{
+		"":                "column 1: unexpected end of expression",
+		"1 +":             "column 4: unexpected end of expression",
+		"'a' * 2":         "column 5: * of a string and a number",
+		"1 + 'a'":         "column 3: + of a number and a string",
+		"!2":              "column 1: ! of a number",
+		"true ? 1":        "column 9: expected : after ?",
+		"1 ? 2 : 3":       "column 3: condition is a number, not a bool",
+		"level == 'full'": "",
+		"1 == 'a'":        "column 3: == compare a number with a string",
+		"sqrt(1, 2)":      "column 1: wrong number of arguments for sqrt",
+		"system('ls')":    "column 1: unknown function system",
+		"sqrt('a')":       "column 1: sqrt argument 1 is a string, not a number",
+		"(1 + 2":          "column 7: expected )",
+		"level = 2":       "column 7: unexpected character '='",
+		"'abc":            "column 1: unterminated string",
+		"1 2":             "column 3: unexpected 2",
+	} {
+		a := assertions.New(t)
+		_, err := compileExpr(src)
+		if msg == "" {
+			a.So(err, assertions.ShouldBeNil)
+			continue
+		}
+		a.So(err, assertions.ShouldNotBeNil)
+		if err != nil {
+			a.So(err.Error(), assertions.ShouldEqual, msg)
+		}
+	}
+}
+
+func TestCompute(t *testing.T) {
+	a := assertions.New(t)
+	sch := NewMapper(map[string]*Schema{"tank": {
+		Attrs:   map[string]string{"level": "liters", "fill": "percentage", "ratio": "number"},
+		Compute: map[string]string{"fill": "100 * level / params.capacity", "ratio": "level / params.empty"},
+		Params:  map[string]interface{}{"capacity": 200, "empty": 0},
+	}}).All()["tank"]
+	ents, err := decode(log.Get(), map[string]interface{}{"id": "tank-1", "level": 100.0}, sch, nil)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ents[0].Attributes["level"].Value, assertions.ShouldEqual, 100.0)
+	a.So(ents[0].Attributes["fill"].Value, assertions.ShouldEqual, 50.0)
+	_, ok := ents[0].Attributes["ratio"]
+	a.So(ok, assertions.ShouldBeFalse)
+}
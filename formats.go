@@ -0,0 +1,168 @@
+package bridges
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// FormatDecoder turn the content of the data field into message fields. data is the field content, after the
+// encodings of the format are removed.
+type FormatDecoder func(data []byte, opts SchemaData) (map[string]interface{}, error)
+
+// Encoding remove a text encoding of binary data.
+type Encoding func(data []byte) ([]byte, error)
+
+// formats are the decoders usable as last part of Schema.Data.Format.
+var formats = map[string]FormatDecoder{
+	"json":   decodeJSON,
+	"csv":    decodeCSV,
+	"form":   decodeForm,
+	"cbor":   decodeCBOR,
+	"lpp":    decodeLPP,
+	"binary": decodeBinary,
+}
+
+// encodings are the encodings usable before the decoder in Schema.Data.Format, like base64+cbor.
+var encodings = map[string]Encoding{
+	"base64": decodeBase64,
+	"hex":    decodeHex,
+}
+
+// RegisterFormat add a decoder for the data format name. It must be called before the schemas are loaded.
+func RegisterFormat(name string, dec FormatDecoder) {
+	formats[name] = dec
+}
+
+// dataFormat is a parsed Schema.Data.Format.
+type dataFormat struct {
+	encodings []Encoding
+	decoder   FormatDecoder
+	name      string
+}
+
+// parseFormat read a data format: encodings followed by a decoder, separated by +. The decoder is json when the format
+// is empty or only has encodings, so base64 is the same as base64+json.
+func parseFormat(format string) (dataFormat, error) {
+	f := dataFormat{decoder: decodeJSON, name: "json"}
+	if format == "" {
+		return f, nil
+	}
+	parts := strings.Split(format, "+")
+	for i, part := range parts {
+		if enc, ok := encodings[part]; ok {
+			f.encodings = append(f.encodings, enc)
+			continue
+		}
+		dec, ok := formats[part]
+		if !ok || i != len(parts)-1 {
+			return f, fmt.Errorf("unsupported data format %q", format)
+		}
+		f.decoder, f.name = dec, part
+	}
+	return f, nil
+}
+
+// decode turn the data field content into message fields. A nested object is only accepted by the json format.
+func (f dataFormat) decode(field interface{}, opts SchemaData) (map[string]interface{}, error) {
+	var data []byte
+	switch field := field.(type) {
+	case string:
+		data = []byte(field)
+	case map[string]interface{}:
+		if f.name != "json" || len(f.encodings) > 0 {
+			return nil, fmt.Errorf("%s data must be a string, got an object", opts.Format)
+		}
+		return field, nil
+	default:
+		return nil, fmt.Errorf("unsupported field type %T", field)
+	}
+	var err error
+	for _, enc := range f.encodings {
+		if data, err = enc(data); err != nil {
+			return nil, err
+		}
+	}
+	return f.decoder(data, opts)
+}
+
+func decodeBase64(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	out := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(out, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %s", err)
+	}
+	return out[:n], nil
+}
+
+func decodeHex(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	out := make([]byte, hex.DecodedLen(len(data)))
+	n, err := hex.Decode(out, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %s", err)
+	}
+	return out[:n], nil
+}
+
+func decodeJSON(data []byte, opts SchemaData) (map[string]interface{}, error) {
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("data is not a JSON object: %s", err)
+	}
+	return msg, nil
+}
+
+// decodeCSV read a single CSV line, values are named by opts.Columns. Empty column names skip a value.
+func decodeCSV(data []byte, opts SchemaData) (map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	if opts.Delimiter != "" {
+		r.Comma = []rune(opts.Delimiter)[0]
+	}
+	record, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %s", err)
+	}
+	if len(record) != len(opts.Columns) {
+		return nil, fmt.Errorf("got %d CSV values for %d columns", len(record), len(opts.Columns))
+	}
+	msg := make(map[string]interface{}, len(record))
+	for i, col := range opts.Columns {
+		if col != "" {
+			msg[col] = strings.TrimSpace(record[i])
+		}
+	}
+	return msg, nil
+}
+
+// decodeForm read URL encoded values. Keys given more than once keep their first value.
+func decodeForm(data []byte, opts SchemaData) (map[string]interface{}, error) {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid form: %s", err)
+	}
+	msg := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		msg[k] = v[0]
+	}
+	return msg, nil
+}
+
+func decodeCBOR(data []byte, opts SchemaData) (map[string]interface{}, error) {
+	v, err := unmarshalCBOR(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CBOR: %s", err)
+	}
+	msg, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("CBOR data is a %T, not a map", v)
+	}
+	return msg, nil
+}
@@ -0,0 +1,73 @@
+package bridges
+
+import (
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestParseFormat(t *testing.T) {
+	a := assertions.New(t)
+	for _, format := range []string{"", "json", "base64", "hex+cbor", "base64+csv", "form"} {
+		_, err := parseFormat(format)
+		a.So(err, assertions.ShouldBeNil)
+	}
+	for _, format := range []string{"xml", "cbor+base64", "json+csv", "base64+"} {
+		_, err := parseFormat(format)
+		a.So(err, assertions.ShouldNotBeNil)
+	}
+}
+
+func TestDataFormats(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		data  SchemaData
+		field interface{}
+		out   map[string]interface{}
+	}{
+		{"json", SchemaData{}, `{"level": 12}`, map[string]interface{}{"level": 12.0}},
+		{"object", SchemaData{}, map[string]interface{}{"level": 12.0}, map[string]interface{}{"level": 12.0}},
+		{"base64", SchemaData{Format: "base64"}, "eyJsZXZlbCI6IDEyfQ==", map[string]interface{}{"level": 12.0}},
+		{"csv", SchemaData{Format: "csv", Columns: []string{"level", "", "valve"}, Delimiter: ";"}, "12; 3;true",
+			map[string]interface{}{"level": "12", "valve": "true"}},
+		{"form", SchemaData{Format: "form"}, "level=12&valve=true&level=13",
+			map[string]interface{}{"level": "12", "valve": "true"}},
+		// {"level": 12, "temp": 1.5 (half float), "tags": [_ "a"]}
+		{"cbor", SchemaData{Format: "hex+cbor"}, "a3656c6576656c0c6474656d70f93e0064746167739f6161ff",
+			map[string]interface{}{"level": 12.0, "temp": 1.5, "tags": []interface{}{"a"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assertions.New(t)
+			f, err := parseFormat(tt.data.Format)
+			a.So(err, assertions.ShouldBeNil)
+			out, err := f.decode(tt.field, tt.data)
+			a.So(err, assertions.ShouldBeNil)
+			a.So(out, assertions.ShouldResemble, tt.out)
+		})
+	}
+}
+
+func TestDataFormatErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		data  SchemaData
+		field interface{}
+	}{
+		{"json array", SchemaData{}, `[1, 2]`},
+		{"base64 object", SchemaData{Format: "base64"}, map[string]interface{}{}},
+		{"bad base64", SchemaData{Format: "base64"}, "!!"},
+		{"csv columns", SchemaData{Format: "csv", Columns: []string{"level"}}, "1,2"},
+		{"cbor array", SchemaData{Format: "hex+cbor"}, "8101"},
+		{"cbor trailing", SchemaData{Format: "hex+cbor"}, "a0a0"},
+		{"cbor short", SchemaData{Format: "hex+cbor"}, "a1616c"},
+		{"cbor break", SchemaData{Format: "hex+cbor"}, "a1ff"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assertions.New(t)
+			f, err := parseFormat(tt.data.Format)
+			a.So(err, assertions.ShouldBeNil)
+			_, err = f.decode(tt.field, tt.data)
+			a.So(err, assertions.ShouldNotBeNil)
+		})
+	}
+}
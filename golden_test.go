@@ -0,0 +1,70 @@
+package bridges
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestGolden convert every sample message of testdata/golden/<schema>/<name>.json with the schemas of bridges.yml
+// and compare the entity to <name>.golden.json. Run go test -update to write the golden files.
+func TestGolden(t *testing.T) {
+	mapper, err := LoadMapper("bridges.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = func() time.Time {
+		return time.Date(2019, 1, 16, 16, 42, 31, 0, time.UTC)
+	}
+	defer func() { now = time.Now }()
+
+	samples, err := filepath.Glob(filepath.Join("testdata", "golden", "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range samples {
+		if strings.HasSuffix(sample, ".golden.json") {
+			continue
+		}
+		key := filepath.Base(filepath.Dir(sample))
+		golden := strings.TrimSuffix(sample, ".json") + ".golden.json"
+		t.Run(key+"/"+filepath.Base(sample), func(t *testing.T) {
+			body, err := ioutil.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ents, err := Convert(log.Get(), mapper, key, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sch, _ := mapper.Get(key)
+			got, err := json.MarshalIndent(Output(sch, ents), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			if *update {
+				if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("entity mismatch\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package bridges
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// brokerCheckTimeout is the time allowed to the broker to answer a readiness check.
+const brokerCheckTimeout = 2 * time.Second
+
+// bridgeMetrics count the messages received, pushed and failed by bridge, like http_received.
+var bridgeMetrics = expvar.NewMap("bridges")
+
+// statusVars are the metrics shown by /status besides the bridge counters.
+var statusVars = []string{"dispatch", "dedup_duplicates", "rate_limited", "dead_letters", "routes", "ngsi_requests"}
+
+// BuildInfo describe the running binary.
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Go      string `json:"go"`
+}
+
+// Check tell if a dependency of the bridge works, it return why it doesn't.
+type Check func() error
+
+// Health run the readiness checks of the bridge and serve /healthz, /readyz and /status.
+type Health struct {
+	build  BuildInfo
+	start  time.Time
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+// NewHealth return an Health without checks, the uptime start now.
+func NewHealth(build BuildInfo) *Health {
+	build.Go = runtime.Version()
+	return &Health{build: build, start: time.Now(), checks: map[string]Check{}}
+}
+
+// Add register the check name.
+func (h *Health) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Ready run the checks and return their result, ok or the error, and if they all pass.
+func (h *Health) Ready() (map[string]string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	results := make(map[string]string, len(h.checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ready := true
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			result := "ok"
+			if err := check(); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = result
+			ready = ready && result == "ok"
+		}(name, check)
+	}
+	wg.Wait()
+	return results, ready
+}
+
+// register serve the health endpoints on mux. /healthz answer as long as the process serve requests, /readyz 503
+// when a check fail and /status the checks with the uptime, the build and the counters.
+func (h *Health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks, ready := h.Ready()
+		writeJSON(w, readyStatus(ready), map[string]interface{}{"ready": ready, "checks": checks})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		checks, ready := h.Ready()
+		counters := map[string]interface{}{}
+		for _, name := range append([]string{"bridges"}, statusVars...) {
+			if v := expvar.Get(name); v != nil {
+				counters[name] = json.RawMessage(v.String())
+			}
+		}
+		writeJSON(w, readyStatus(ready), map[string]interface{}{
+			"ready":    ready,
+			"checks":   checks,
+			"uptime":   time.Since(h.start).Truncate(time.Second).String(),
+			"started":  h.start.UTC(),
+			"build":    h.build,
+			"counters": counters,
+		})
+	})
+}
+
+func readyStatus(ready bool) int {
+	if ready {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// MapperCheck fail while the mapper has no schema.
+func MapperCheck(m *Mapper) Check {
+	return func() error {
+		if m == nil || len(m.All()) == 0 {
+			return fmt.Errorf("no schema loaded")
+		}
+		return nil
+	}
+}
+
+// BrokerCheck fail when the broker doesn't answer GET /version. The check is sent once, with a short timeout and
+// without the circuit breaker so it doesn't count as a broker failure.
+func BrokerCheck(ctx log.Interface, client *ngsi.Client) Check {
+	probe := *client
+	probe.Retry = ngsi.RetryPolicy{Attempts: 1}
+	probe.HTTP = &http.Client{Timeout: brokerCheckTimeout}
+	probe.Breaker = nil
+	return func() error {
+		_, err := probe.Version(ctx)
+		return err
+	}
+}
+
+// QueueCheck fail when more than threshold messages wait in the dispatcher queues.
+func QueueCheck(d *Dispatcher, threshold int) Check {
+	return func() error {
+		if n := d.Pending(); n > threshold {
+			return fmt.Errorf("%d messages queued, more than %d", n, threshold)
+		}
+		return nil
+	}
+}
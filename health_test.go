@@ -0,0 +1,60 @@
+package bridges
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestHealth(t *testing.T) {
+	a := assertions.New(t)
+	up := true
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.So(r.URL.Path, assertions.ShouldEqual, "/version")
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"orion": {"version": "2.1.0"}}`))
+	}))
+	defer broker.Close()
+
+	h := NewHealth(BuildInfo{Version: "1.2.0"})
+	h.Add("mapper", MapperCheck(NewMapper(map[string]*Schema{"particle": {}})))
+	h.Add("broker", BrokerCheck(log.Get(), ngsi.NewClient(broker.URL)))
+	h.Add("outbox", QueueCheck(nil, 0))
+	mux := http.NewServeMux()
+	h.register(mux)
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var body map[string]interface{}
+		a.So(json.Unmarshal(rec.Body.Bytes(), &body), assertions.ShouldBeNil)
+		return rec.Code, body
+	}
+
+	code, _ := get("/healthz")
+	a.So(code, assertions.ShouldEqual, http.StatusOK)
+	code, body := get("/readyz")
+	a.So(code, assertions.ShouldEqual, http.StatusOK)
+	a.So(body["checks"], assertions.ShouldResemble, map[string]interface{}{"mapper": "ok", "broker": "ok", "outbox": "ok"})
+
+	up = false
+	h.Add("custom", func() error { return errors.New("not ready") })
+	code, body = get("/status")
+	a.So(code, assertions.ShouldEqual, http.StatusServiceUnavailable)
+	a.So(body["ready"], assertions.ShouldEqual, false)
+	a.So(body["checks"].(map[string]interface{})["broker"], assertions.ShouldStartWith, "failed to get broker version")
+	a.So(body["checks"].(map[string]interface{})["custom"], assertions.ShouldEqual, "not ready")
+	a.So(body["build"].(map[string]interface{})["version"], assertions.ShouldEqual, "1.2.0")
+	a.So(body["counters"], assertions.ShouldContainKey, "bridges")
+
+	a.So(MapperCheck(NewMapper(nil))(), assertions.ShouldNotBeNil)
+}
@@ -0,0 +1,258 @@
+package bridges
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/gin-gonic/gin"
+)
+
+// historyPrefix is the path under which the history of the entities is served.
+const historyPrefix = "/history/"
+
+// defaultHistoryRange is the time range of the history queries without start.
+const defaultHistoryRange = 24 * time.Hour
+
+// errNoHistory is returned when querying an entity that was never recorded.
+var errNoHistory = fmt.Errorf("no history for this entity")
+
+// Sample is the value of an attribute at a time.
+type Sample struct {
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+// History keep the attribute values of the entities over time, Orion only keeping the last ones.
+type History interface {
+	// Record add the attribute values of the entities, at their timestamp.
+	Record(ents []*ngsi.Entity) error
+	// Query return the samples of the attributes of the entity id, all of them when attrs is empty, from from,
+	// included, to to, excluded.
+	Query(id string, attrs []string, from, to time.Time) (map[string][]Sample, error)
+}
+
+// FileHistory is an History stored in a directory: a directory by entity holding a JSON lines file by UTC day.
+// The entities are locked one by one so different entities are recorded in parallel.
+type FileHistory struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*entityLock
+}
+
+// entityLock is the lock of an entity, kept while users hold or wait for it.
+type entityLock struct {
+	sync.Mutex
+	users int
+}
+
+type historyLine struct {
+	Time  time.Time              `json:"time"`
+	Attrs map[string]interface{} `json:"attrs"`
+}
+
+// OpenFileHistory return the history stored in the directory dir, creating it if needed.
+func OpenFileHistory(dir string) (*FileHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileHistory{dir: dir, locks: map[string]*entityLock{}}, nil
+}
+
+// entityDir return the directory of the entity id, escaped to stay in the history directory.
+func (h *FileHistory) entityDir(id string) (string, error) {
+	if id == "" || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid entity id %q", id)
+	}
+	return filepath.Join(h.dir, url.PathEscape(id)), nil
+}
+
+// Record append the attribute values of the entities to the file of the day of their timestamp.
+func (h *FileHistory) Record(ents []*ngsi.Entity) error {
+	for _, ent := range ents {
+		if err := h.record(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *FileHistory) record(ent *ngsi.Entity) error {
+	dir, err := h.entityDir(ent.Id)
+	if err != nil {
+		return err
+	}
+	line := historyLine{Time: now().UTC(), Attrs: make(map[string]interface{}, len(ent.Attributes))}
+	for name, attr := range ent.Attributes {
+		if name == "timestamp" {
+			if t, ok := attr.Value.(time.Time); ok {
+				line.Time = t.UTC()
+			}
+			continue
+		}
+		line.Attrs[name] = attr.Value
+	}
+	buff, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	defer h.lock(dir)()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, line.Time.Format(archiveDay)+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(buff, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// lock the directory of an entity and return the function unlocking it. The lock is forgotten once unused so the
+// locks don't grow with the number of entities.
+func (h *FileHistory) lock(dir string) func() {
+	h.mu.Lock()
+	l, ok := h.locks[dir]
+	if !ok {
+		l = &entityLock{}
+		h.locks[dir] = l
+	}
+	l.users++
+	h.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if l.users--; l.users == 0 {
+			delete(h.locks, dir)
+		}
+	}
+}
+
+// Query read the files of the days of the time range.
+func (h *FileHistory) Query(id string, attrs []string, from, to time.Time) (map[string][]Sample, error) {
+	dir, err := h.entityDir(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return nil, errNoHistory
+	}
+	wanted := make(map[string]bool, len(attrs))
+	for _, name := range attrs {
+		wanted[name] = true
+	}
+	series := map[string][]Sample{}
+	from, to = from.UTC(), to.UTC()
+	// The files are not read while a line is appended.
+	defer h.lock(dir)()
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		err := readHistoryFile(filepath.Join(dir, day.Format(archiveDay)+".jsonl"), func(line *historyLine) {
+			if line.Time.Before(from) || !line.Time.Before(to) {
+				return
+			}
+			for name, v := range line.Attrs {
+				if len(wanted) == 0 || wanted[name] {
+					series[name] = append(series[name], Sample{Time: line.Time, Value: v})
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+func readHistoryFile(file string, fn func(*historyLine)) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := &historyLine{}
+		if err := json.Unmarshal(scanner.Bytes(), line); err != nil {
+			return fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		fn(line)
+	}
+	return scanner.Err()
+}
+
+// record add the entities to the history, if there is one, logging when it fail.
+func record(ctx log.Interface, history History, ents []*ngsi.Entity) {
+	if history == nil {
+		return
+	}
+	if err := history.Record(ents); err != nil {
+		ctx.WithError(err).Warn("Could not record history.")
+	}
+}
+
+// newHistoryAPI build the API answering the history of the entities: GET /history/:id with the attrs, a comma
+// separated list of attributes, from and to, RFC 3339 times, query parameters. The range is the last day by default.
+// Every request must carry the token as a bearer Authorization header.
+func newHistoryAPI(ctx log.Interface, history History, token string) *gin.Engine {
+	engine := gin.New()
+	// Entity IDs can contain escaped slashes.
+	engine.UseRawPath = true
+	engine.Use(
+		Logger(ctx.WithField("api", "history")),
+		requestID,
+		jsonError,
+		checkToken(token),
+	)
+	engine.GET(historyPrefix+":id", func(c *gin.Context) {
+		to := now()
+		if s := c.Query("to"); s != "" {
+			var err error
+			if to, err = time.Parse(time.RFC3339, s); err != nil {
+				fail(c, http.StatusBadRequest, codeInvalidQuery, fmt.Errorf("invalid to: %s", err))
+				return
+			}
+		}
+		from := to.Add(-defaultHistoryRange)
+		if s := c.Query("from"); s != "" {
+			var err error
+			if from, err = time.Parse(time.RFC3339, s); err != nil {
+				fail(c, http.StatusBadRequest, codeInvalidQuery, fmt.Errorf("invalid from: %s", err))
+				return
+			}
+		}
+		var attrs []string
+		if s := c.Query("attrs"); s != "" {
+			attrs = strings.Split(s, ",")
+		}
+		id := c.Param("id")
+		series, err := history.Query(id, attrs, from, to)
+		switch {
+		case err == errNoHistory:
+			failEntity(c, http.StatusNotFound, codeNoHistory, id, fmt.Errorf("no history for %s", id))
+		case err != nil:
+			failEntity(c, http.StatusInternalServerError, codeInternal, id, err)
+		default:
+			c.JSON(http.StatusOK, gin.H{"id": id, "from": from.UTC(), "to": to.UTC(), "attrs": series})
+		}
+	})
+	return engine
+}
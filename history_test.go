@@ -0,0 +1,75 @@
+package bridges
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestFileHistory(t *testing.T) {
+	a := assertions.New(t)
+	dir, err := ioutil.TempDir("", "history")
+	a.So(err, assertions.ShouldBeNil)
+	defer os.RemoveAll(dir)
+	h, err := OpenFileHistory(dir)
+	a.So(err, assertions.ShouldBeNil)
+
+	start := time.Date(2019, 1, 16, 23, 0, 0, 0, time.UTC)
+	tank := func(at time.Time, level, temp float64) []*ngsi.Entity {
+		return []*ngsi.Entity{{Id: "urn:tank/1", Type: "WaterTank", Attributes: map[string]ngsi.Attribute{
+			"level":     {AttrPair: ngsi.AttrPair{Value: level, Type: "liters"}},
+			"temp":      {AttrPair: ngsi.AttrPair{Value: temp, Type: "celsius"}},
+			"timestamp": {AttrPair: ngsi.AttrPair{Value: at, Type: "time"}},
+		}}}
+	}
+	for i := 0; i < 4; i++ {
+		a.So(h.Record(tank(start.Add(time.Duration(i)*30*time.Minute), float64(100+i), 6)), assertions.ShouldBeNil)
+	}
+
+	series, err := h.Query("urn:tank/1", []string{"level"}, start.Add(30*time.Minute), start.Add(2*time.Hour))
+	a.So(err, assertions.ShouldBeNil)
+	a.So(series, assertions.ShouldHaveLength, 1)
+	a.So(series["level"], assertions.ShouldResemble, []Sample{
+		{Time: start.Add(30 * time.Minute), Value: 101.0},
+		{Time: start.Add(time.Hour), Value: 102.0},
+		{Time: start.Add(90 * time.Minute), Value: 103.0},
+	})
+	a.So(h.locks, assertions.ShouldBeEmpty)
+	_, err = h.Query("urn:tank/2", nil, start, start.Add(time.Hour))
+	a.So(err, assertions.ShouldEqual, errNoHistory)
+	_, err = h.Query("..", nil, start, start.Add(time.Hour))
+	a.So(err, assertions.ShouldNotBeNil)
+
+	api := newHistoryAPI(log.Get(), h, "secret")
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		api.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+	code, body := get("/history/urn:tank%2F1?from=2019-01-16T23:00:00Z&to=2019-01-17T00:00:00Z")
+	a.So(code, assertions.ShouldEqual, 200)
+	a.So(body["attrs"].(map[string]interface{})["temp"], assertions.ShouldHaveLength, 2)
+	code, body = get("/history/urn:tank%2F1?from=yesterday")
+	a.So(code, assertions.ShouldEqual, 400)
+	a.So(body["code"], assertions.ShouldEqual, codeInvalidQuery)
+	code, body = get("/history/tank-2")
+	a.So(code, assertions.ShouldEqual, 404)
+	a.So(body["code"], assertions.ShouldEqual, codeNoHistory)
+	a.So(body["entityId"], assertions.ShouldEqual, "tank-2")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("GET", "/history/urn:tank%2F1", nil))
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusUnauthorized)
+}
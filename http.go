@@ -1,12 +1,15 @@
 package bridges
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"ngsi-bridge/ngsi"
+	"strconv"
 
 	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/gin-gonic/gin"
@@ -15,23 +18,38 @@ import (
 // HTTPBridge define the http endpoint. It use the http framework to handle the HTTP request and a fiware.Agent to
 // contact Fiware IoT broker
 type HTTPBridge struct {
-	ctx       log.Interface
-	port      int
-	engine    *gin.Engine
-	mapper    map[string]*Schema
-	brokerURL string
-	method    string
-}
+	// AdminToken enable the admin API under /admin/ for the clients presenting it as bearer token.
+	AdminToken string
+	// Changes remember the values pushed for the schemas reporting by exception.
+	Changes *ChangeCache
+	// Dedup drop the retried messages of the schemas deduplicating them.
+	Dedup *Deduplicator
+	// Dispatch push the messages with a worker pool, they are pushed by the request goroutine when nil.
+	Dispatch *Dispatcher
+	// Limits reject the messages over the rate limits with 429 Too Many Requests.
+	Limits *RateLimiter
+	// DeadLetters store the messages that could not be converted or pushed.
+	DeadLetters *DeadLetters
+	// Archive keep every message received.
+	Archive *Archive
+	// History record the entities pushed and serve them under /history/.
+	History History
+	// HistoryToken enable the history API for the clients presenting it as bearer token, AdminToken is used when
+	// empty. Without any token the history is recorded but not served.
+	HistoryToken string
+	// Routes send the entities to other destinations than the broker.
+	Routes *Router
+	// Health serve /healthz, /readyz and /status.
+	Health *Health
 
-type Schema struct {
-	Type    string
-	Attrs   map[string]string
-	Replace map[string]string
-	ID      string
-	Data    struct {
-		Field  string
-		Format string
-	}
+	ctx     log.Interface
+	port    int
+	engine  *gin.Engine
+	admin   *gin.Engine
+	history *gin.Engine
+	mapper  *Mapper
+	broker  *ngsi.Client
+	method  string
 }
 
 func NewHttpBridge(port int) *HTTPBridge {
@@ -41,16 +59,17 @@ func NewHttpBridge(port int) *HTTPBridge {
 }
 
 // Prepare the HTTP server. This a non blocking call
-func (h *HTTPBridge) Prepare(ctx log.Interface, mapper map[string]*Schema, brokerURL, method string) (err error) {
+func (h *HTTPBridge) Prepare(ctx log.Interface, mapper *Mapper, broker *ngsi.Client, method string) (err error) {
 	h.ctx = ctx.WithField("endpoint", "HTTP")
 	h.ctx.Info("Building bridge...")
 	h.mapper = mapper
-	h.brokerURL = brokerURL
+	h.broker = broker
 	h.method = method
 	h.engine = gin.New()
 	h.engine.Use(
 		Logger(h.ctx),
-		gin.ErrorLoggerT(gin.ErrorTypePublic),
+		requestID,
+		jsonError,
 		//checkHeaders
 	)
 	h.engine.GET("/", h.Schemas)
@@ -60,13 +79,42 @@ func (h *HTTPBridge) Prepare(ctx log.Interface, mapper map[string]*Schema, broke
 	}, h.decode, h.push)
 	h.engine.POST(key, h.decode, h.push)
 	h.engine.POST(key+"/register", h.decode, h.register)
+	h.engine.POST(key+"/dry-run", h.dryRun)
 	h.engine.GET(key, h.Encode)
+	if h.AdminToken != "" {
+		h.admin = newAdmin(h.ctx, mapper, h.AdminToken)
+	}
+	if h.History != nil {
+		token := h.HistoryToken
+		if token == "" {
+			token = h.AdminToken
+		}
+		if token != "" {
+			h.history = newHistoryAPI(h.ctx, h.History, token)
+		} else {
+			h.ctx.Warn("No history or admin token, the history is not served.")
+		}
+	}
 	h.ctx.Info("Bridge built.")
 	return nil
 }
 
+// Open start serving the bridge. Operational endpoints are served next to the gin engine because its router doesn't
+// allow static routes beside /:key.
 func (h *HTTPBridge) Open() error {
-	return h.engine.Run(fmt.Sprintf(":%d", h.port))
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if h.admin != nil {
+		mux.Handle(adminPrefix, h.admin)
+	}
+	if h.history != nil {
+		mux.Handle(historyPrefix, h.history)
+	}
+	if h.Health != nil {
+		h.Health.register(mux)
+	}
+	mux.Handle("/", h.engine)
+	return http.ListenAndServe(fmt.Sprintf(":%d", h.port), mux)
 }
 
 func (h *HTTPBridge) Close() error {
@@ -74,82 +122,193 @@ func (h *HTTPBridge) Close() error {
 }
 
 func (h *HTTPBridge) push(context *gin.Context) {
-	ent, err := retrieveEntity(context)
+	ents, err := retrieveEntities(context)
 	if err != nil {
-		context.AbortWithError(http.StatusInternalServerError, err)
+		fail(context, http.StatusInternalServerError, codeInternal, err)
 		return
 	}
-	if err = ngsi.PushAttributes(h.ctx, h.brokerURL, ent); err != nil {
-		context.AbortWithError(http.StatusInternalServerError, err)
+	sch := context.MustGet("schema").(*Schema)
+	err = h.Dispatch.Do(dispatchKey(ents), func() error {
+		record(h.ctx, h.History, ents)
+		key := context.GetString("key")
+		h.Routes.Send(key, ents)
+		if !h.Routes.Primary(key) {
+			return nil
+		}
+		return push(h.ctx, h.broker, h.Changes, sch, ents)
+	})
+	switch err {
+	case nil:
+		bridgeMetrics.Add("http_pushed", 1)
+		context.Status(http.StatusOK)
+	case ErrQueueFull, ErrDropped, ErrClosed:
+		context.Header("Retry-After", "1")
+		fail(context, http.StatusServiceUnavailable, codeOverloaded, err)
+	default:
+		bridgeMetrics.Add("http_failed", 1)
+		h.deadLetter(context.GetString("key"), context.MustGet("body").([]byte), err)
+		failEntity(context, http.StatusBadGateway, codeBrokerError, dispatchKey(ents), err)
 	}
-	context.Status(http.StatusOK)
 }
 
 func (h *HTTPBridge) register(context *gin.Context) {
-	ent, err := retrieveEntity(context)
+	ents, err := retrieveEntities(context)
 	if err != nil {
-		context.AbortWithError(http.StatusInternalServerError, err)
+		fail(context, http.StatusInternalServerError, codeInternal, err)
 		return
 	}
-	if err = ngsi.RegisterEntity(h.ctx, h.brokerURL, ent); err != nil {
-		context.AbortWithError(http.StatusInternalServerError, err)
+	if len(ents) == 1 {
+		err = h.broker.RegisterEntity(h.ctx, ents[0])
+	} else {
+		err = h.broker.BatchUpdate(h.ctx, ngsi.AppendStrictAction, ents)
+	}
+	if err != nil {
+		failEntity(context, http.StatusBadGateway, codeBrokerError, dispatchKey(ents), err)
+		return
 	}
 	context.Status(http.StatusOK)
 }
 
-func retrieveEntity(context *gin.Context) (*ngsi.Entity, error) {
+// dryRun answer the entity a message would be converted to, without sending it to the broker. The entities are
+// answered as an array when the schema split messages.
+func (h *HTTPBridge) dryRun(ctx *gin.Context) {
+	key := ctx.Param("key")
+	buff, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		fail(ctx, http.StatusBadRequest, codeInvalidBody, err)
+		return
+	}
+	sch, ok := h.mapper.Get(key)
+	if !ok {
+		fail(ctx, http.StatusNotFound, codeUnknownSchema, fmt.Errorf("no schema found for %s", key))
+		return
+	}
+	ents, err := Convert(h.ctx, h.mapper, key, buff)
+	if err != nil {
+		fail(ctx, http.StatusBadRequest, codeDecodeFailed, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, Output(sch, ents))
+}
+
+// push send the entities of a message to the broker, in a single batch when the message was split. Only the changed
+// attributes are sent when the schema report by exception.
+func push(ctx log.Interface, broker *ngsi.Client, changes *ChangeCache, sch *Schema, ents []*ngsi.Entity) error {
+	ents = changes.Filter(sch.Report, ents)
+	var err error
+	switch len(ents) {
+	case 0:
+		return nil
+	case 1:
+		err = broker.PushAttributes(ctx, ents[0])
+	default:
+		err = broker.PushEntities(ctx, ents)
+	}
+	if err != nil {
+		changes.Forget(ents)
+	}
+	return err
+}
+
+// dispatchKey return the ID ordering the push of the entities of a message: the entity of the message, first when
+// it is split.
+func dispatchKey(ents []*ngsi.Entity) string {
+	if len(ents) == 0 {
+		return ""
+	}
+	return ents[0].Id
+}
+
+func retrieveEntities(context *gin.Context) ([]*ngsi.Entity, error) {
 	it, ok := context.Get("element")
 	if !ok {
 		return nil, fmt.Errorf("no element pushed")
 	}
-	elem, ok := it.(ngsi.Entity)
+	elems, ok := it.([]*ngsi.Entity)
 	if !ok {
 		return nil, fmt.Errorf("cannot convert to ngsi element")
 	}
-	return &elem, nil
+	return elems, nil
 }
 
 func (h *HTTPBridge) Schemas(ctx *gin.Context) {
-	ctx.JSON(http.StatusOK, h.mapper)
+	ctx.JSON(http.StatusOK, h.mapper.All())
 }
 
 func (h *HTTPBridge) decode(ctx *gin.Context) {
-	ctx.Status(http.StatusBadRequest)
-
 	buff, err := ioutil.ReadAll(ctx.Request.Body)
-	buff = bytes.Replace(buff, []byte{'\\', '"'}, []byte{'"'}, -1)
-	buff = bytes.Replace(buff, []byte("data="), []byte(""), 1)
-	msg := make(map[string]interface{})
-	err = json.Unmarshal(buff, &msg)
 	if err != nil {
-		ctx.Error(err).SetType(gin.ErrorTypePrivate)
-		ctx.Error(fmt.Errorf("field msg format can not be parsed to a map[string]interface")).SetType(gin.ErrorTypePublic)
-		ctx.Abort()
+		fail(ctx, http.StatusBadRequest, codeInvalidBody, err)
 		return
 	}
-
 	key := ctx.Param("key")
 	if key == "" {
-		keyI, ok := ctx.Get("key")
-		if !ok {
-			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("no schema found for %s", key)).SetType(gin.ErrorTypePublic)
-			return
-		}
-		key = keyI.(string)
+		key = ctx.GetString("key")
+	}
+	ctx.Set("key", key)
+	bridgeMetrics.Add("http_received", 1)
+	if err = h.Archive.Append("http", key, buff); err != nil {
+		h.ctx.WithError(err).Warn("Could not archive message.")
+	}
+	msg, err := parseMessage(buff)
+	if err != nil {
+		h.deadLetter(key, buff, err)
+		ctx.Error(err).SetType(gin.ErrorTypePrivate)
+		fail(ctx, http.StatusBadRequest, codeInvalidJSON, fmt.Errorf("message must be a JSON object"))
+		return
 	}
-	sch, ok := h.mapper[key]
+	sch, ok := h.mapper.Get(key)
 	if !ok {
-		ctx.Error(fmt.Errorf("no schema found for %s", key)).SetType(gin.ErrorTypePublic)
-		ctx.Abort()
+		err = fmt.Errorf("no schema found for %s", key)
+		h.deadLetter(key, buff, err)
+		fail(ctx, http.StatusNotFound, codeUnknownSchema, err)
+		return
+	}
+	// A duplicate was already handled, it is acknowledged so the sender stop retrying.
+	fp, dup := h.Dedup.Duplicate(key, sch, msg, ctx.GetHeader, buff)
+	if dup {
+		ctx.AbortWithStatus(http.StatusOK)
 		return
 	}
+	// A message that could not be pushed is forgotten so its retry isn't taken for a duplicate.
+	defer func() {
+		if ctx.Writer.Status() >= http.StatusBadRequest {
+			h.Dedup.Forget(fp)
+		}
+	}()
 
-	ent, err := decode(msg, sch)
+	ents, err := decode(h.ctx, msg, sch, h.mapper.Devices)
 	if err != nil {
-		ctx.Error(err).SetType(gin.ErrorTypePublic)
-		ctx.Abort()
+		h.deadLetter(key, buff, err)
+		fail(ctx, http.StatusBadRequest, codeDecodeFailed, err)
+		return
+	}
+	if reason, wait := h.Limits.Allow(key, sch, dispatchKey(ents), clientID(ctx)); reason != "" {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		failEntity(ctx, http.StatusTooManyRequests, codeRateLimited, dispatchKey(ents), fmt.Errorf("%s rate limit exceeded", reason))
+		return
+	}
+	ctx.Set("element", ents)
+	ctx.Set("schema", sch)
+	ctx.Set("body", buff)
+	ctx.Next()
+}
+
+// deadLetter store a message that failed, logging when it can't.
+func (h *HTTPBridge) deadLetter(key string, body []byte, cause error) {
+	if err := h.DeadLetters.Add("http", key, body, cause); err != nil {
+		h.ctx.WithError(err).Warn("Could not store dead letter.")
+	}
+}
+
+// clientID identify the client of a request for the rate limits: by a hash of its credentials when it send some, so
+// they are not kept in memory, by its address otherwise.
+func clientID(ctx *gin.Context) string {
+	if auth := ctx.GetHeader("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "auth:" + hex.EncodeToString(sum[:])
 	}
-	ctx.Set("element", ent)
+	return ctx.ClientIP()
 }
 
 func (h *HTTPBridge) Encode(ctx *gin.Context) {
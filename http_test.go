@@ -1,12 +1,113 @@
 package bridges
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
-	"github.com/TheThingsIndustries/integration-messaging/ngsi10/ngsi10"
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/gin-gonic/gin"
+	"github.com/smartystreets/assertions"
 )
 
 func TestHttpBridge_Particle(t *testing.T) {
 	bridge := NewHttpBridge(8080)
-	bridge.Prepare(nil, map[string]*ngsi10.Schema{}, "localhost:1026/ngsi10/updateContext", "POST")
+	bridge.Prepare(log.Get(), NewMapper(nil), ngsi.NewClient("localhost:1026"), "POST")
+}
+
+func TestHttpBridge_Errors(t *testing.T) {
+	a := assertions.New(t)
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broker.Close()
+	client := ngsi.NewClient(broker.URL)
+	client.Retry = ngsi.RetryPolicy{Attempts: 1}
+	bridge := NewHttpBridge(8080)
+	mapper := NewMapper(map[string]*Schema{"tank": {Attrs: map[string]string{"level": "liters"}}})
+	a.So(bridge.Prepare(log.Get(), mapper, client, "POST"), assertions.ShouldBeNil)
+
+	post := func(path, body string) (int, errorEnvelope, http.Header) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(requestIDHeader, "req-1")
+		rec := httptest.NewRecorder()
+		bridge.engine.ServeHTTP(rec, req)
+		var env errorEnvelope
+		json.Unmarshal(rec.Body.Bytes(), &env)
+		return rec.Code, env, rec.Header()
+	}
+
+	code, env, header := post("/pump", `{"id": "pump-1"}`)
+	a.So(code, assertions.ShouldEqual, http.StatusNotFound)
+	a.So(env, assertions.ShouldResemble, errorEnvelope{Code: codeUnknownSchema, Message: "no schema found for pump", Schema: "pump", RequestID: "req-1"})
+	a.So(header.Get(requestIDHeader), assertions.ShouldEqual, "req-1")
+
+	code, env, _ = post("/tank", `[1, 2]`)
+	a.So(code, assertions.ShouldEqual, http.StatusBadRequest)
+	a.So(env.Code, assertions.ShouldEqual, codeInvalidJSON)
+	a.So(env.Schema, assertions.ShouldEqual, "tank")
+
+	code, env, _ = post("/tank", `{"id": "tank-1", "level": 10}`)
+	a.So(code, assertions.ShouldEqual, http.StatusBadGateway)
+	a.So(env.Code, assertions.ShouldEqual, codeBrokerError)
+	a.So(env.EntityID, assertions.ShouldEqual, "tank-1")
+	a.So(env.RequestID, assertions.ShouldEqual, "req-1")
+
+	code, env, _ = post("/pump/dry-run", `{"id": "pump-1"}`)
+	a.So(code, assertions.ShouldEqual, http.StatusNotFound)
+	a.So(env.Code, assertions.ShouldEqual, codeUnknownSchema)
+}
+
+func TestHttpBridge_DedupRetry(t *testing.T) {
+	a := assertions.New(t)
+	var requests int
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer broker.Close()
+	client := ngsi.NewClient(broker.URL)
+	client.Retry = ngsi.RetryPolicy{Attempts: 1}
+	bridge := NewHttpBridge(8080)
+	bridge.Dedup = NewDeduplicator()
+	mapper := NewMapper(map[string]*Schema{"tank": {
+		Attrs: map[string]string{"level": "liters"},
+		Dedup: &SchemaDedup{Header: "X-Message-Id"},
+	}})
+	a.So(bridge.Prepare(log.Get(), mapper, client, "POST"), assertions.ShouldBeNil)
+
+	post := func() int {
+		req := httptest.NewRequest("POST", "/tank", strings.NewReader(`{"id": "tank-1", "level": 10}`))
+		req.Header.Set("X-Message-Id", "msg-1")
+		rec := httptest.NewRecorder()
+		bridge.engine.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	a.So(post(), assertions.ShouldEqual, http.StatusBadGateway)
+	a.So(post(), assertions.ShouldEqual, http.StatusOK)
+	a.So(requests, assertions.ShouldEqual, 2)
+	a.So(post(), assertions.ShouldEqual, http.StatusOK)
+	a.So(requests, assertions.ShouldEqual, 2)
+}
+
+func TestClientID(t *testing.T) {
+	a := assertions.New(t)
+	id := func(auth string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/tank", nil)
+		c.Request.Header.Set("Authorization", auth)
+		return clientID(c)
+	}
+	a.So(id("Bearer secret"), assertions.ShouldNotContainSubstring, "secret")
+	a.So(id("Bearer secret"), assertions.ShouldEqual, id("Bearer secret"))
+	a.So(id("Bearer secret"), assertions.ShouldNotEqual, id("Bearer other"))
+	a.So(id(""), assertions.ShouldEqual, "192.0.2.1")
 }
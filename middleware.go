@@ -1,7 +1,8 @@
 package bridges
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"time"
 
@@ -9,6 +10,55 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// Error codes of the error responses.
+const (
+	codeInvalidBody   = "invalid_body"
+	codeInvalidJSON   = "invalid_json"
+	codeUnknownSchema = "unknown_schema"
+	codeDecodeFailed  = "decode_failed"
+	codeRateLimited   = "rate_limited"
+	codeOverloaded    = "overloaded"
+	codeBrokerError   = "broker_error"
+	codeInternal      = "internal_error"
+	codeUnauthorized  = "unauthorized"
+	codeInvalidSchema = "invalid_schema"
+	codeSchemaInUse   = "schema_in_use"
+	codeUnknownDevice = "unknown_device"
+	codeInvalidQuery  = "invalid_query"
+	codeNoHistory     = "no_history"
+)
+
+// requestIDHeader carry the ID of a request, generated when the client doesn't send one.
+const requestIDHeader = "X-Request-ID"
+
+// errorEnvelope is the body of the error responses of the HTTP bridge.
+type errorEnvelope struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Schema    string `json:"schema,omitempty"`
+	EntityID  string `json:"entityId,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// errorMeta is the meta of the public errors, completing their envelope.
+type errorMeta struct {
+	code     string
+	entityID string
+}
+
+// fail abort the request with status, the error is answered in an envelope by jsonError.
+func fail(c *gin.Context, status int, code string, err error) {
+	failEntity(c, status, code, "", err)
+}
+
+// failEntity is fail for an error about the entity id.
+func failEntity(c *gin.Context, status int, code, id string, err error) {
+	// The status is not written yet, so jsonError can still answer the envelope.
+	c.Status(status)
+	c.Error(err).SetType(gin.ErrorTypePublic).SetMeta(errorMeta{code, id})
+	c.Abort()
+}
+
 // Logger middleware for http.
 func Logger(ctx log.Interface) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -24,25 +74,42 @@ func Logger(ctx log.Interface) gin.HandlerFunc {
 				version = "unknown"
 			}
 		}
+		id := c.GetString("requestId")
+		if id == "" {
+			id = c.GetHeader(requestIDHeader)
+		}
 		fields := log.Fields{
 			"Method":        c.Request.Method,
 			"Path":          c.Request.URL.Path,
 			"Query":         c.Request.URL.Query(),
 			"Host":          c.Request.Host,
-			"Id":            c.GetHeader("X-Request-ID"),
+			"Id":            id,
 			"RemoteAddress": c.ClientIP(),
 			"Duration":      end.Sub(start),
 			"Status":        c.Writer.Status(),
 			"Version":       version,
 		}
+		logger := ctx
 		if err := c.Errors.ByType(gin.ErrorTypePrivate).Last(); err != nil {
-			ctx = ctx.WithError(err)
+			logger = logger.WithError(err)
 		}
 		if err := c.Errors.ByType(gin.ErrorTypePublic).Last(); err != nil {
-			fmt.Println(err)
+			fields["Error"] = err.Error()
 		}
-		ctx.WithFields(fields).Info("Inbound request")
+		logger.WithFields(fields).Info("Inbound request")
+	}
+}
+
+// requestID give every request an ID, the one sent by the client or a random one, answered in X-Request-ID.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" {
+		buff := make([]byte, 8)
+		rand.Read(buff)
+		id = hex.EncodeToString(buff)
 	}
+	c.Set("requestId", id)
+	c.Header(requestIDHeader, id)
 }
 
 func checkHeaders(c *gin.Context) {
@@ -53,11 +120,29 @@ func checkHeaders(c *gin.Context) {
 	}
 }
 
+// jsonError answer the last public error of the request in an error envelope, with the schema key of the request
+// and the request ID.
 func jsonError(c *gin.Context) {
 	c.Next()
 	lastError := c.Errors.ByType(gin.ErrorTypePublic).Last()
-	if lastError == nil {
+	if lastError == nil || c.Writer.Written() {
 		return
 	}
-	c.JSON(-1, lastError)
+	env := errorEnvelope{
+		Code:      codeInternal,
+		Message:   lastError.Error(),
+		Schema:    c.GetString("key"),
+		RequestID: c.GetString("requestId"),
+	}
+	if env.Schema == "" {
+		env.Schema = c.Param("key")
+	}
+	if meta, ok := lastError.Meta.(errorMeta); ok {
+		env.Code, env.EntityID = meta.code, meta.entityID
+	}
+	status := c.Writer.Status()
+	if status < http.StatusBadRequest {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, env)
 }
@@ -3,6 +3,9 @@ package bridges
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"ngsi-bridge/ngsi"
 
@@ -17,11 +20,27 @@ type TTNBridge struct {
 	ctx        log.Interface
 	Ttn        TtnAccess
 	ClientName string
-	client     ttnSdk.Client
-	pubSub     ttnSdk.ApplicationPubSub
-	work       func(up *ttnTypes.UplinkMessage)
-	schemas    map[string]*Schema
-	broker     string
+	// Changes remember the values pushed for the schemas reporting by exception.
+	Changes *ChangeCache
+	// Dedup drop the retried uplinks of the schemas deduplicating them.
+	Dedup *Deduplicator
+	// Dispatch push the uplinks with a worker pool, they are pushed one at a time when nil.
+	Dispatch *Dispatcher
+	// Limits drop the uplinks over the rate limits.
+	Limits *RateLimiter
+	// DeadLetters store the uplinks that could not be converted or pushed.
+	DeadLetters *DeadLetters
+	// Archive keep every uplink received, as the message converted by the schemas.
+	Archive *Archive
+	// History record the entities pushed.
+	History History
+	// Routes send the entities to other destinations than the broker.
+	Routes  *Router
+	client  ttnSdk.Client
+	pubSub  ttnSdk.ApplicationPubSub
+	work    func(up *ttnTypes.UplinkMessage)
+	schemas *Mapper
+	broker  *ngsi.Client
 }
 
 // TtnAccess value to access TTN
@@ -35,7 +54,7 @@ type TtnAccess struct {
 
 // StartMQTT create and start a TTNBridge on the community network. Subribe to all the device uplink message and start
 // a go routine that listen for incoming uplink to send them to Fiware.
-func (m *TTNBridge) Prepare(ctx log.Interface, mapperSchema map[string]*Schema, broker string) error {
+func (m *TTNBridge) Prepare(ctx log.Interface, mapper *Mapper, broker *ngsi.Client) error {
 	config := ttnSdk.NewConfig(m.ClientName, m.Ttn.AccountServer, m.Ttn.DiscoveryServer)
 	m.ctx = ctx.WithField("endpoint", "MQTT")
 	m.ctx.Info("Building bridge...")
@@ -50,7 +69,8 @@ func (m *TTNBridge) Prepare(ctx log.Interface, mapperSchema map[string]*Schema,
 			return errors.New("could not use CA certificate")
 		}
 	}
-	m.schemas = mapperSchema
+	m.schemas = mapper
+	m.broker = broker
 	m.client = config.NewClient(m.Ttn.AppID, m.Ttn.AppKey)
 	m.work = m.handleUp
 	m.ctx.Info("Bridge built.")
@@ -79,6 +99,7 @@ func (m *TTNBridge) Open() error {
 	}
 	m.ctx.Info("Bridging complete.")
 	for uplink := range up {
+		bridgeMetrics.Add("ttn_received", 1)
 		m.work(uplink)
 	}
 	m.ctx.Info("Bridging closed.")
@@ -91,19 +112,78 @@ func (m *TTNBridge) handleUp(up *ttnTypes.UplinkMessage) {
 		m.ctx.Debug("No type attribute using 'ttn'.")
 		t = "ttn"
 	}
-	sch, ok := m.schemas[t]
+	msg := uplinkMessage(up)
+	body, err := json.Marshal(msg)
+	if err == nil {
+		err = m.Archive.Append("ttn", t, body)
+	}
+	if err != nil {
+		m.ctx.WithError(err).Warn("Could not archive uplink.")
+	}
+	sch, ok := m.schemas.Get(t)
 	if !ok {
-		m.ctx.Warnf("No schema defined for type %s", t)
+		m.ctx.Warnf("No schema defined for type %s and no %s schema", t, DefaultSchema)
+		m.deadLetter(t, body, fmt.Errorf("no schema found for %s", t))
+		return
+	}
+	fp, dup := m.Dedup.Duplicate(t, sch, msg, nil, append([]byte(up.DevID+"\x00"), up.PayloadRaw...))
+	if dup {
+		m.ctx.WithField("dev_id", up.DevID).Debug("Dropped duplicate uplink.")
 		return
 	}
-	ent, err := decode(up.PayloadFields, sch)
+	ents, err := decode(m.ctx, msg, sch, m.schemas.Devices)
 	if err != nil {
+		m.Dedup.Forget(fp)
 		m.ctx.WithError(err).Warn("Could not decode uplink.")
+		m.deadLetter(t, body, err)
 		return
 	}
-	err = ngsi.PushAttributes(m.ctx, m.broker, ent)
-	if err != nil {
-		m.ctx.WithError(err).Warn("Could not push entity to broker.")
+	if reason, _ := m.Limits.Allow(t, sch, dispatchKey(ents), ""); reason != "" {
+		m.Dedup.Forget(fp)
+		m.ctx.WithField("dev_id", up.DevID).Debugf("Dropped uplink over the %s rate limit.", reason)
 		return
 	}
+	err = m.Dispatch.Go(dispatchKey(ents), func() {
+		record(m.ctx, m.History, ents)
+		m.Routes.Send(t, ents)
+		if !m.Routes.Primary(t) {
+			return
+		}
+		if err := push(m.ctx, m.broker, m.Changes, sch, ents); err != nil {
+			m.Dedup.Forget(fp)
+			bridgeMetrics.Add("ttn_failed", 1)
+			m.ctx.WithError(err).Warn("Could not push entity to broker.")
+			m.deadLetter(t, body, err)
+			return
+		}
+		bridgeMetrics.Add("ttn_pushed", 1)
+	})
+	if err != nil {
+		m.Dedup.Forget(fp)
+		m.ctx.WithError(err).WithField("dev_id", up.DevID).Warn("Could not dispatch uplink.")
+	}
+}
+
+// deadLetter store an uplink that failed, as the message converted by the schemas, logging when it can't.
+func (m *TTNBridge) deadLetter(key string, body []byte, cause error) {
+	if err := m.DeadLetters.Add("ttn", key, body, cause); err != nil {
+		m.ctx.WithError(err).Warn("Could not store dead letter.")
+	}
+}
+
+// uplinkMessage return the message decoded by the schemas: the payload fields, with the device fields and the raw
+// payload as encoded by TTN, base64, when the payload has no field of the same name.
+func uplinkMessage(up *ttnTypes.UplinkMessage) map[string]interface{} {
+	msg := map[string]interface{}{
+		"app_id":          up.AppID,
+		"dev_id":          up.DevID,
+		"hardware_serial": up.HardwareSerial,
+		"port":            float64(up.FPort),
+		"counter":         float64(up.FCnt),
+		"payload_raw":     base64.StdEncoding.EncodeToString(up.PayloadRaw),
+	}
+	for k, v := range up.PayloadFields {
+		msg[k] = v
+	}
+	return msg
 }
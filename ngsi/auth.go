@@ -0,0 +1,212 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expiryMargin is removed from the token lifetime so a token is refreshed before the broker rejects it.
+const expiryMargin = 30 * time.Second
+
+// TokenSource provide the token sent to the broker with every request. Invalidate is called when the broker answered
+// 401 so the next call to Token fetch a fresh one.
+type TokenSource interface {
+	Token() (string, error)
+	Invalidate()
+}
+
+// StaticToken is a token that never expire, for example a long lived token given by the PEP proxy administrator.
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+func (t StaticToken) Invalidate() {}
+
+// fetcher retrieve a new token and its expiration date. A zero time means the token doesn't expire.
+type fetcher func() (string, time.Time, error)
+
+// cachedToken keep the last token fetched until it expires or is invalidated.
+type cachedToken struct {
+	mu      sync.Mutex
+	fetch   fetcher
+	token   string
+	expires time.Time
+}
+
+func newCachedToken(fetch fetcher) *cachedToken {
+	return &cachedToken{fetch: fetch}
+}
+
+func (c *cachedToken) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return c.token, nil
+	}
+	token, expires, err := c.fetch()
+	if err != nil {
+		return "", err
+	}
+	if !expires.IsZero() {
+		expires = expires.Add(-expiryMargin)
+	}
+	c.token, c.expires = token, expires
+	return token, nil
+}
+
+func (c *cachedToken) Invalidate() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
+
+// OAuth2 get a token with the client credentials grant from a Keyrock or Keycloak token endpoint.
+type OAuth2 struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// TokenSource return a cached token source for the OAuth2 configuration.
+func (o OAuth2) TokenSource() TokenSource {
+	return newCachedToken(o.fetch)
+}
+
+func (o OAuth2) fetch() (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	buff, _, err := authRequest(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("oauth2 token request failed: %s", err)
+	}
+	resp := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err = json.Unmarshal(buff, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("oauth2 token response can not be parsed: %s", err)
+	}
+	if resp.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("oauth2 token response has no access_token")
+	}
+	var expires time.Time
+	if resp.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return resp.AccessToken, expires, nil
+}
+
+// Keystone get a token with the Keystone v3 password authentication. URL is the Keystone base URL, without /v3.
+type Keystone struct {
+	URL      string
+	User     string
+	Password string
+	Domain   string
+	Project  string
+}
+
+// TokenSource return a cached token source for the Keystone configuration.
+func (k Keystone) TokenSource() TokenSource {
+	return newCachedToken(k.fetch)
+}
+
+type keystoneDomain struct {
+	Name string `json:"name"`
+}
+
+type keystoneAuth struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string         `json:"name"`
+					Password string         `json:"password"`
+					Domain   keystoneDomain `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope *keystoneScope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type keystoneScope struct {
+	Project struct {
+		Name   string         `json:"name"`
+		Domain keystoneDomain `json:"domain"`
+	} `json:"project"`
+}
+
+func (k Keystone) fetch() (string, time.Time, error) {
+	domain := k.Domain
+	if domain == "" {
+		domain = "Default"
+	}
+	auth := keystoneAuth{}
+	auth.Auth.Identity.Methods = []string{"password"}
+	auth.Auth.Identity.Password.User.Name = k.User
+	auth.Auth.Identity.Password.User.Password = k.Password
+	auth.Auth.Identity.Password.User.Domain.Name = domain
+	if k.Project != "" {
+		auth.Auth.Scope = &keystoneScope{}
+		auth.Auth.Scope.Project.Name = k.Project
+		auth.Auth.Scope.Project.Domain.Name = domain
+	}
+	req, err := prepareRequest(strings.TrimSuffix(k.URL, "/")+"/v3/auth/tokens", "POST", auth)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	buff, header, err := authRequest(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("keystone token request failed: %s", err)
+	}
+	token := header.Get("X-Subject-Token")
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("keystone response has no X-Subject-Token header")
+	}
+	resp := struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"token"`
+	}{}
+	if err = json.Unmarshal(buff, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("keystone token response can not be parsed: %s", err)
+	}
+	return token, resp.Token.ExpiresAt, nil
+}
+
+// authRequest send a request to an identity server and return the body and headers of a successful response.
+func authRequest(req *http.Request) ([]byte, http.Header, error) {
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	buff, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("requestURL=%v code=%v body=%v", req.URL, resp.StatusCode, string(buff))
+	}
+	return buff, resp.Header, nil
+}
+
+var authClient = &http.Client{Timeout: 30 * time.Second}
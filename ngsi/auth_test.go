@@ -0,0 +1,78 @@
+package ngsi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestOAuth2TokenSource(t *testing.T) {
+	a := assertions.New(t)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		id, secret, _ := r.BasicAuth()
+		a.So(id, assertions.ShouldEqual, "bridge")
+		a.So(secret, assertions.ShouldEqual, "secret")
+		a.So(r.FormValue("grant_type"), assertions.ShouldEqual, "client_credentials")
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, calls)
+	}))
+	defer srv.Close()
+
+	src := OAuth2{TokenURL: srv.URL, ClientID: "bridge", ClientSecret: "secret"}.TokenSource()
+	tok, err := src.Token()
+	a.So(err, assertions.ShouldBeNil)
+	a.So(tok, assertions.ShouldEqual, "token1")
+	tok, err = src.Token()
+	a.So(err, assertions.ShouldBeNil)
+	a.So(tok, assertions.ShouldEqual, "token1")
+	src.Invalidate()
+	tok, err = src.Token()
+	a.So(err, assertions.ShouldBeNil)
+	a.So(tok, assertions.ShouldEqual, "token2")
+}
+
+func TestKeystoneTokenSource(t *testing.T) {
+	a := assertions.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.So(r.URL.Path, assertions.ShouldEqual, "/v3/auth/tokens")
+		w.Header().Set("X-Subject-Token", "keystone-token")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"token":{"expires_at":"2100-01-01T00:00:00.000000Z"}}`)
+	}))
+	defer srv.Close()
+
+	tok, err := Keystone{URL: srv.URL, User: "bridge", Password: "secret"}.TokenSource().Token()
+	a.So(err, assertions.ShouldBeNil)
+	a.So(tok, assertions.ShouldEqual, "keystone-token")
+}
+
+func TestClientRetryUnauthorized(t *testing.T) {
+	a := assertions.New(t)
+	calls := 0
+	tokens := OAuth2{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			calls++
+			fmt.Fprintf(w, `{"access_token":"token%d"}`, calls)
+			return
+		}
+		if r.Header.Get("X-Auth-Token") != "token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	tokens.TokenURL = srv.URL + "/token"
+
+	client := NewClient(srv.URL)
+	client.Tokens = tokens.TokenSource()
+	err := client.PushAttributes(log.Get(), &Entity{Id: "tank", Type: "WaterTank"})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(calls, assertions.ShouldEqual, 2)
+}
@@ -0,0 +1,44 @@
+package ngsi
+
+import (
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+const batchUpdate = "/v2/op/update"
+
+// ActionType tell the broker what to do with the entities of a batch update.
+type ActionType string
+
+const (
+	// AppendAction create the entities and attributes that don't exist and update the others.
+	AppendAction ActionType = "append"
+	// AppendStrictAction only create entities and attributes, existing ones are errors.
+	AppendStrictAction ActionType = "append_strict"
+	// UpdateAction only update existing attributes.
+	UpdateAction ActionType = "update"
+	// DeleteAction remove the attributes, or the entities when they have no attribute.
+	DeleteAction ActionType = "delete"
+	// ReplaceAction replace all the attributes of the entities.
+	ReplaceAction ActionType = "replace"
+)
+
+type batch struct {
+	ActionType ActionType `json:"actionType"`
+	Entities   []*Entity  `json:"entities"`
+}
+
+// BatchUpdate apply an action to several entities in a single request.
+func (c *Client) BatchUpdate(ctx log.Interface, action ActionType, entities []*Entity) error {
+	ctx.Infof("Batch %s entities=%d", action, len(entities))
+	if _, err := c.request(ctx, batchUpdate, "POST", batch{action, entities}); err != nil {
+		return errors.Wrapf(err, "failed to %s entities", action)
+	}
+	return nil
+}
+
+// PushEntities create or update several entities in a single request, the entities and attributes missing in the
+// broker are created.
+func (c *Client) PushEntities(ctx log.Interface, entities []*Entity) error {
+	return c.BatchUpdate(ctx, AppendAction, entities)
+}
@@ -0,0 +1,36 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestPushEntities(t *testing.T) {
+	a := assertions.New(t)
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.So(r.URL.Path, assertions.ShouldEqual, "/v2/op/update")
+		buff, _ := ioutil.ReadAll(r.Body)
+		a.So(json.Unmarshal(buff, &body), assertions.ShouldBeNil)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL)
+	err := client.PushEntities(log.Get(), []*Entity{
+		{Id: "gw", Type: "Gateway"},
+		{Id: "gw-0", Type: "Sensor", Attributes: map[string]Attribute{"temp": {AttrPair: AttrPair{Value: 12.5, Type: "celsius"}}}},
+	})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(body["actionType"], assertions.ShouldEqual, "append")
+	a.So(body["entities"], assertions.ShouldResemble, []interface{}{
+		map[string]interface{}{"id": "gw", "type": "Gateway"},
+		map[string]interface{}{"id": "gw-0", "type": "Sensor", "temp": map[string]interface{}{"value": 12.5, "type": "celsius"}},
+	})
+}
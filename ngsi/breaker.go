@@ -0,0 +1,124 @@
+package ngsi
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// ErrBreakerOpen is returned without contacting the broker while the circuit breaker is open.
+var ErrBreakerOpen = errors.New("broker circuit breaker is open")
+
+// breakerStates publish the state of every breaker, by name, on /debug/vars.
+var breakerStates = expvar.NewMap("ngsi_breakers")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker stop sending requests to an unhealthy broker. After Threshold consecutive failures it opens and every
+// request fail fast with ErrBreakerOpen. Once Cooldown is elapsed a single request is let through: the breaker closes
+// if it succeeds and opens again otherwise.
+type Breaker struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker return a closed breaker. Name identify the breaker in logs and metrics.
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+	b := &Breaker{
+		Name:      name,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+	}
+	breakerStates.Set(name, stateVar(BreakerClosed))
+	return b
+}
+
+// State return the current breaker state.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow return ErrBreakerOpen if the request must not be sent.
+func (b *Breaker) Allow(ctx log.Interface) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return ErrBreakerOpen
+		}
+		b.transition(ctx, BreakerHalfOpen)
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Report the outcome of a request allowed by Allow.
+func (b *Breaker) Report(ctx log.Interface, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(ctx, BreakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.Threshold) {
+		b.openedAt = time.Now()
+		b.transition(ctx, BreakerOpen)
+	}
+}
+
+func (b *Breaker) transition(ctx log.Interface, to BreakerState) {
+	ctx.WithFields(log.Fields{
+		"breaker":  b.Name,
+		"from":     b.state.String(),
+		"to":       to.String(),
+		"failures": b.failures,
+	}).Warn("Broker circuit breaker state changed")
+	b.state = to
+	breakerStates.Set(b.Name, stateVar(to))
+}
+
+func stateVar(s BreakerState) *expvar.String {
+	v := new(expvar.String)
+	v.Set(s.String())
+	return v
+}
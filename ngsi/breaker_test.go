@@ -0,0 +1,62 @@
+package ngsi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestBreaker(t *testing.T) {
+	a := assertions.New(t)
+	ctx := log.Get()
+	b := NewBreaker("test", 2, 10*time.Millisecond)
+
+	a.So(b.Allow(ctx), assertions.ShouldBeNil)
+	b.Report(ctx, false)
+	a.So(b.State(), assertions.ShouldEqual, BreakerClosed)
+	a.So(b.Allow(ctx), assertions.ShouldBeNil)
+	b.Report(ctx, false)
+	a.So(b.State(), assertions.ShouldEqual, BreakerOpen)
+	a.So(b.Allow(ctx), assertions.ShouldEqual, ErrBreakerOpen)
+
+	time.Sleep(10 * time.Millisecond)
+	a.So(b.Allow(ctx), assertions.ShouldBeNil)
+	a.So(b.State(), assertions.ShouldEqual, BreakerHalfOpen)
+	a.So(b.Allow(ctx), assertions.ShouldEqual, ErrBreakerOpen)
+	b.Report(ctx, true)
+	a.So(b.State(), assertions.ShouldEqual, BreakerClosed)
+}
+
+func TestClientRetry(t *testing.T) {
+	a := assertions.New(t)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if calls == 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL)
+	client.Retry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	err := client.PushAttributes(log.Get(), &Entity{Id: "tank", Type: "WaterTank"})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(calls, assertions.ShouldEqual, 3)
+
+	calls = 1
+	err = client.RegisterEntity(log.Get(), &Entity{Id: "tank", Type: "WaterTank"})
+	a.So(err, assertions.ShouldNotBeNil)
+	a.So(calls, assertions.ShouldEqual, 2)
+}
@@ -0,0 +1,172 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MarshalJSON write the entity in the NGSI v2 normalized representation: id, idPattern and type followed by the
+// attributes sorted by name. Attributes named like a reserved field are skipped.
+func (e Entity) MarshalJSON() ([]byte, error) {
+	buff := &bytes.Buffer{}
+	buff.WriteByte('{')
+	first := true
+	field := func(key string, value interface{}) error {
+		if !first {
+			buff.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		buff.Write(k)
+		buff.WriteByte(':')
+		v, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("attribute %s: %s", key, err)
+		}
+		buff.Write(v)
+		return nil
+	}
+	if e.Id != "" {
+		field("id", e.Id)
+	}
+	if e.IdPattern != "" {
+		field("idPattern", e.IdPattern)
+	}
+	field("type", e.Type)
+	names := make([]string, 0, len(e.Attributes))
+	for name := range e.Attributes {
+		if !reserved(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := field(name, e.Attributes[name]); err != nil {
+			return nil, err
+		}
+	}
+	buff.WriteByte('}')
+	return buff.Bytes(), nil
+}
+
+// UnmarshalJSON read an entity in the normalized representation, with its fields in any order. Attributes that are
+// not normalized, like {"lat": 52.3}, are read as keyValues values with an empty type. b is never modified.
+func (e *Entity) UnmarshalJSON(b []byte) error {
+	return e.decode(b, Normalized)
+}
+
+// decode read an entity in the representation rep: normalized or keyValues, whose attribute types are left empty.
+func (e *Entity) decode(b []byte, rep Representation) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("entity must be a JSON object, got %v", tok)
+	}
+	ent := Entity{}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		switch key {
+		case "id":
+			err = decodeString(dec, key, &ent.Id)
+		case "idPattern":
+			err = decodeString(dec, key, &ent.IdPattern)
+		case "type":
+			err = decodeString(dec, key, &ent.Type)
+		default:
+			var attr Attribute
+			if attr, err = decodeAttribute(dec, rep); err != nil {
+				err = fmt.Errorf("attribute %s: %s", key, err)
+				break
+			}
+			if ent.Attributes == nil {
+				ent.Attributes = make(map[string]Attribute)
+			}
+			ent.Attributes[key] = attr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = dec.Token(); err != nil {
+		return err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after entity")
+	}
+	*e = ent
+	return nil
+}
+
+func reserved(name string) bool {
+	return name == "id" || name == "idPattern" || name == "type"
+}
+
+func decodeString(dec *json.Decoder, key string, s *string) error {
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("entity %s must be a string, got %T", key, v)
+	}
+	*s = str
+	return nil
+}
+
+// decodeAttribute read an attribute in the representation rep. In the normalized representation an object with only
+// value, type and metadata fields is a normalized attribute, anything else is a value. In the keyValues
+// representation everything is a value.
+func decodeAttribute(dec *json.Decoder, rep Representation) (Attribute, error) {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return Attribute{}, err
+	}
+	var fields map[string]json.RawMessage
+	if rep == Normalized && json.Unmarshal(raw, &fields) == nil && normalized(fields) {
+		attr := Attribute{}
+		if v, ok := fields["value"]; ok {
+			if err := json.Unmarshal(v, &attr.Value); err != nil {
+				return Attribute{}, err
+			}
+		}
+		if t, ok := fields["type"]; ok {
+			if err := json.Unmarshal(t, &attr.Type); err != nil {
+				return Attribute{}, fmt.Errorf("type must be a string")
+			}
+		}
+		if m, ok := fields["metadata"]; ok {
+			if err := json.Unmarshal(m, &attr.Metadata); err != nil {
+				return Attribute{}, fmt.Errorf("invalid metadata: %s", err)
+			}
+		}
+		return attr, nil
+	}
+	attr := Attribute{}
+	return attr, json.Unmarshal(raw, &attr.Value)
+}
+
+func normalized(fields map[string]json.RawMessage) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	for k := range fields {
+		if k != "value" && k != "type" && k != "metadata" {
+			return false
+		}
+	}
+	return true
+}
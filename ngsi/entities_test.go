@@ -43,3 +43,64 @@ func TestEntityJSON(t *testing.T) {
 	a.So(err, assertions.ShouldBeNil)
 	a.So(tmp, assertions.ShouldResemble, ent)
 }
+
+func TestEntityUnmarshal(t *testing.T) {
+	a := assertions.New(t)
+	in := []byte(`{"temp":{"metadata":{"unit":{"type":"Text","value":"celsius"}},"value":21.5,"type":"Number"},"type":"WaterTank","id":"urn:ngsi-ld:WaterTank:tank-1"}`)
+	orig := append([]byte{}, in...)
+	ent := Entity{}
+	err := json.Unmarshal(in, &ent)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(in, assertions.ShouldResemble, orig)
+	a.So(ent.Id, assertions.ShouldEqual, "urn:ngsi-ld:WaterTank:tank-1")
+	a.So(ent.Type, assertions.ShouldEqual, "WaterTank")
+	a.So(ent.IdPattern, assertions.ShouldEqual, "")
+	a.So(ent.Attributes["temp"], assertions.ShouldResemble, Attribute{
+		AttrPair: AttrPair{Value: 21.5, Type: "Number"},
+		Metadata: map[string]AttrPair{"unit": {Value: "celsius", Type: "Text"}},
+	})
+
+	buff, err := json.Marshal(ent)
+	a.So(err, assertions.ShouldBeNil)
+	tmp := Entity{}
+	a.So(json.Unmarshal(buff, &tmp), assertions.ShouldBeNil)
+	a.So(tmp, assertions.ShouldResemble, ent)
+
+	err = json.Unmarshal([]byte(`{"id":"tank","type":"WaterTank","level":1.6,"location":{"lat":52.3,"lon":4.9}}`), &ent)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ent.Attributes["level"].Value, assertions.ShouldEqual, 1.6)
+	a.So(ent.Attributes["location"].Value, assertions.ShouldResemble, map[string]interface{}{"lat": 52.3, "lon": 4.9})
+
+	for _, in := range []string{`[]`, `{"id":1}`, `{"id":"a"`, `{"id":"a"}{}`} {
+		a.So(json.Unmarshal([]byte(in), &ent), assertions.ShouldNotBeNil)
+	}
+
+	// A keyValues value can look like a normalized attribute.
+	ents, err := Query{Options: KeyValues}.decode([]byte(`[{"id":"tank","type":"WaterTank","a":{"type":1}}]`))
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ents[0].Attributes["a"], assertions.ShouldResemble, Attribute{AttrPair: AttrPair{Value: map[string]interface{}{"type": 1.0}}})
+}
+
+func FuzzEntityUnmarshal(f *testing.F) {
+	f.Add([]byte(`{"id":"hello","idPattern":"testPattern","type":"test","testValue":{"value":"test","type":"testType"}}`))
+	f.Add([]byte(`{"type":"T","id":"urn:a:b","x":{"value":1,"metadata":{"m":{"value":2}}}}`))
+	f.Add([]byte(`{"id":"a","x":[1,{"value":2}],"y":null}`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		orig := append([]byte{}, b...)
+		ent := Entity{}
+		err := json.Unmarshal(b, &ent)
+		if string(b) != string(orig) {
+			t.Fatal("input modified")
+		}
+		if err != nil {
+			return
+		}
+		buff, err := json.Marshal(ent)
+		if err != nil {
+			t.Fatalf("marshal %q: %s", b, err)
+		}
+		if err = json.Unmarshal(buff, &Entity{}); err != nil {
+			t.Fatalf("unmarshal %q: %s", buff, err)
+		}
+	})
+}
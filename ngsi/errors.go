@@ -0,0 +1,65 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Error is returned when the broker answer with an error status. Orion describe the error in the body, for example
+// {"error":"NotFound","description":"The requested entity has not been found. Check type and id"}.
+type Error struct {
+	Status      int    `json:"-"`
+	URL         string `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"description"`
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(body, e); err != nil {
+		e.Description = string(body)
+	}
+	e.Status = resp.StatusCode
+	if resp.Request != nil {
+		e.URL = resp.Request.URL.String()
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("request failed requestURL=%v code=%v error=%v description=%v", e.URL, e.Status, e.Code, e.Description)
+}
+
+// StatusCode return the HTTP status of a broker error, or 0 if err was not returned by the broker.
+func StatusCode(err error) int {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Status
+	}
+	return 0
+}
+
+// IsNotFound tell if the entity or attribute targeted by the request doesn't exist.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// IsConflict tell if the request conflict with an existing resource. Orion answer 422 Already Exists instead of 409
+// when registering an entity twice.
+func IsConflict(err error) bool {
+	switch StatusCode(err) {
+	case http.StatusConflict:
+		return true
+	case http.StatusUnprocessableEntity:
+		return errors.Cause(err).(*Error).Description == "Already Exists"
+	}
+	return false
+}
+
+// IsUnprocessable tell if the broker refused the request content, for example a forbidden character in an attribute
+// name.
+func IsUnprocessable(err error) bool {
+	return StatusCode(err) == http.StatusUnprocessableEntity
+}
@@ -0,0 +1,63 @@
+package ngsi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+	"github.com/smartystreets/assertions"
+)
+
+func TestErrorHelpers(t *testing.T) {
+	a := assertions.New(t)
+	notFound := errors.Wrap(&Error{Status: 404, Code: "NotFound"}, "failed")
+	exists := &Error{Status: 422, Code: "Unprocessable", Description: "Already Exists"}
+	badAttr := &Error{Status: 422, Code: "BadRequest", Description: "Invalid characters in attribute name"}
+
+	a.So(IsNotFound(notFound), assertions.ShouldBeTrue)
+	a.So(IsNotFound(fmt.Errorf("code=404")), assertions.ShouldBeFalse)
+	a.So(IsConflict(exists), assertions.ShouldBeTrue)
+	a.So(IsConflict(badAttr), assertions.ShouldBeFalse)
+	a.So(IsUnprocessable(badAttr), assertions.ShouldBeTrue)
+	a.So(StatusCode(nil), assertions.ShouldEqual, 0)
+}
+
+func TestPushAttributesRegister(t *testing.T) {
+	a := assertions.New(t)
+	var registerStatus int
+	var pushes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/entities" {
+			w.WriteHeader(registerStatus)
+			if registerStatus == http.StatusUnprocessableEntity {
+				fmt.Fprint(w, `{"error":"Unprocessable","description":"Already Exists"}`)
+			}
+			return
+		}
+		pushes++
+		if pushes == 1 {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"NotFound","description":"The requested entity has not been found. Check type and id"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	client := NewClient(srv.URL)
+	ent := &Entity{Id: "tank", Type: "WaterTank"}
+
+	registerStatus = http.StatusCreated
+	a.So(client.PushAttributes(log.Get(), ent), assertions.ShouldBeNil)
+	a.So(pushes, assertions.ShouldEqual, 1)
+
+	pushes, registerStatus = 0, http.StatusUnprocessableEntity
+	a.So(client.PushAttributes(log.Get(), ent), assertions.ShouldBeNil)
+	a.So(pushes, assertions.ShouldEqual, 2)
+
+	pushes, registerStatus = 0, http.StatusBadRequest
+	err := client.PushAttributes(log.Get(), ent)
+	a.So(StatusCode(err), assertions.ShouldEqual, http.StatusBadRequest)
+}
@@ -0,0 +1,71 @@
+package ngsi
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+// ldUpsert create the NGSI-LD entities or update their attributes, keeping the others.
+const ldUpsert = "/ngsi-ld/v1/entityOperations/upsert?options=update"
+
+// LDContextLink return the Link header referencing the JSON-LD @context of the entities sent to a NGSI-LD broker.
+func LDContextLink(context string) string {
+	return fmt.Sprintf(`<%s>; rel="http://www.w3.org/ns/json-ld#context"; type="application/ld+json"`, context)
+}
+
+// LDEntity return the NGSI-LD representation of an entity. IDs that are not URIs are prefixed with
+// urn:ngsi-ld:<type>:, Relationship attributes become relationships, geo:json ones geo-properties and the others
+// properties with their metadata as sub-properties. The timestamp attribute is the observedAt of the properties.
+func LDEntity(e *Entity) map[string]interface{} {
+	id := e.Id
+	if !strings.Contains(id, ":") {
+		id = fmt.Sprintf("urn:ngsi-ld:%s:%s", e.Type, id)
+	}
+	ld := map[string]interface{}{"id": id, "type": e.Type}
+	var observedAt string
+	if ts, ok := e.Attributes["timestamp"]; ok {
+		if t, ok := ts.Value.(time.Time); ok {
+			observedAt = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	for name, attr := range e.Attributes {
+		if name == "timestamp" || reserved(name) {
+			continue
+		}
+		var prop map[string]interface{}
+		switch attr.Type {
+		case "Relationship":
+			prop = map[string]interface{}{"type": "Relationship", "object": attr.Value}
+		case "geo:json":
+			prop = map[string]interface{}{"type": "GeoProperty", "value": attr.Value}
+		default:
+			prop = map[string]interface{}{"type": "Property", "value": attr.Value}
+		}
+		for m, meta := range attr.Metadata {
+			prop[m] = map[string]interface{}{"type": "Property", "value": meta.Value}
+		}
+		if observedAt != "" {
+			prop["observedAt"] = observedAt
+		}
+		ld[name] = prop
+	}
+	return ld
+}
+
+// UpsertLD create or update entities on a NGSI-LD broker. Set the Link header of the client to LDContextLink to use
+// another @context than the core one.
+func (c *Client) UpsertLD(ctx log.Interface, entities []*Entity) error {
+	ctx.Infof("Upsert NGSI-LD entities=%d", len(entities))
+	ld := make([]map[string]interface{}, len(entities))
+	for i, e := range entities {
+		ld[i] = LDEntity(e)
+	}
+	if _, err := c.request(ctx, ldUpsert, "POST", ld); err != nil {
+		return errors.Wrap(err, "failed to upsert NGSI-LD entities")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestUpsertLD(t *testing.T) {
+	a := assertions.New(t)
+	var body []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.So(r.URL.Path, assertions.ShouldEqual, "/ngsi-ld/v1/entityOperations/upsert")
+		a.So(r.URL.Query().Get("options"), assertions.ShouldEqual, "update")
+		a.So(r.Header.Get("NGSILD-Tenant"), assertions.ShouldEqual, "waternet")
+		buff, _ := ioutil.ReadAll(r.Body)
+		a.So(json.Unmarshal(buff, &body), assertions.ShouldBeNil)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL)
+	client.Headers = http.Header{"Ngsild-Tenant": {"waternet"}}
+	at := time.Date(2019, 1, 16, 16, 0, 0, 0, time.UTC)
+	err := client.UpsertLD(log.Get(), []*Entity{{Id: "tank-1", Type: "WaterTank", Attributes: map[string]Attribute{
+		"level":     {AttrPair: AttrPair{Value: 120.0, Type: "liters"}, Metadata: map[string]AttrPair{"accuracy": {Value: 0.5, Type: "Number"}}},
+		"refDevice": {AttrPair: AttrPair{Value: "gw", Type: "Relationship"}},
+		"timestamp": {AttrPair: AttrPair{Value: at, Type: "time"}},
+	}}})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(body, assertions.ShouldResemble, []map[string]interface{}{{
+		"id":   "urn:ngsi-ld:WaterTank:tank-1",
+		"type": "WaterTank",
+		"level": map[string]interface{}{
+			"type": "Property", "value": 120.0, "observedAt": "2019-01-16T16:00:00Z",
+			"accuracy": map[string]interface{}{"type": "Property", "value": 0.5},
+		},
+		"refDevice": map[string]interface{}{"type": "Relationship", "object": "gw", "observedAt": "2019-01-16T16:00:00Z"},
+	}})
+}
@@ -0,0 +1,358 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+// DefaultPageSize is the number of entities asked per page when Query.Limit is not set.
+const DefaultPageSize = 100
+
+// Representation of the entities returned by a query.
+type Representation string
+
+const (
+	Normalized Representation = ""
+	KeyValues  Representation = "keyValues"
+	Values     Representation = "values"
+)
+
+// Query select entities with GET /v2/entities. Fields left to their zero value are not sent to the broker. With the
+// Values representation the broker only return attribute values, Attrs must be set to know which attribute each value
+// belongs to.
+type Query struct {
+	ID          []string
+	IDPattern   string
+	Type        []string
+	TypePattern string
+	Q           SQ
+	MQ          SQ
+	Attrs       []string
+	OrderBy     []string
+	Geo         *GeoQuery
+	Limit       int
+	Offset      int
+	Options     Representation
+}
+
+// GeoQuery restrict a query to the entities whose location match Georel against the Geometry described by Coords,
+// see the Geographical Queries section of the NGSI v2 specification.
+type GeoQuery struct {
+	Georel   string
+	Geometry string
+	Coords   string
+}
+
+// Near select entities at most maxDistance meters from the point.
+func Near(lat, lon, maxDistance float64) *GeoQuery {
+	return &GeoQuery{
+		Georel:   "near;maxDistance:" + formatFloat(maxDistance),
+		Geometry: "point",
+		Coords:   formatFloat(lat) + "," + formatFloat(lon),
+	}
+}
+
+// CoveredBy select entities located inside the polygon, given as a closed list of [lat, lon] points.
+func CoveredBy(polygon [][2]float64) *GeoQuery {
+	coords := make([]string, len(polygon))
+	for i, p := range polygon {
+		coords[i] = formatFloat(p[0]) + "," + formatFloat(p[1])
+	}
+	return &GeoQuery{
+		Georel:   "coveredBy",
+		Geometry: "polygon",
+		Coords:   strings.Join(coords, ";"),
+	}
+}
+
+// SQ is a Simple Query Language expression used in Query.Q and Query.MQ. Every statement must be true for an entity
+// to match. For MQ the attribute is the metadata path, like temp.accuracy. The language has no escape, a statement
+// with a string containing ' or ; is kept out and Err return why.
+type SQ struct {
+	statements []string
+	err        error
+}
+
+func (s SQ) Equal(attr string, values ...interface{}) SQ {
+	str, err := formatValues(values)
+	return s.add(attr+"=="+str, err)
+}
+
+func (s SQ) NotEqual(attr string, values ...interface{}) SQ {
+	str, err := formatValues(values)
+	return s.add(attr+"!="+str, err)
+}
+
+func (s SQ) Greater(attr string, value interface{}) SQ {
+	str, err := formatValue(value)
+	return s.add(attr+">"+str, err)
+}
+
+func (s SQ) GreaterOrEqual(attr string, value interface{}) SQ {
+	str, err := formatValue(value)
+	return s.add(attr+">="+str, err)
+}
+
+func (s SQ) Less(attr string, value interface{}) SQ {
+	str, err := formatValue(value)
+	return s.add(attr+"<"+str, err)
+}
+
+func (s SQ) LessOrEqual(attr string, value interface{}) SQ {
+	str, err := formatValue(value)
+	return s.add(attr+"<="+str, err)
+}
+
+func (s SQ) Between(attr string, min, max interface{}) SQ {
+	from, err := formatValue(min)
+	if err != nil {
+		return s.add("", err)
+	}
+	to, err := formatValue(max)
+	return s.add(attr+"=="+from+".."+to, err)
+}
+
+func (s SQ) Match(attr, pattern string) SQ {
+	return s.add(attr+"~="+pattern, checkString(pattern))
+}
+
+func (s SQ) Exists(attr string) SQ {
+	return s.add(attr, nil)
+}
+
+func (s SQ) NotExists(attr string) SQ {
+	return s.add("!"+attr, nil)
+}
+
+// add append the statement, or keep the first error.
+func (s SQ) add(statement string, err error) SQ {
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+		return s
+	}
+	s.statements = append(s.statements, statement)
+	return s
+}
+
+// Err return why a statement could not be added to the expression.
+func (s SQ) Err() error {
+	return s.err
+}
+
+func (s SQ) String() string {
+	return strings.Join(s.statements, ";")
+}
+
+func formatValues(values []interface{}) (string, error) {
+	str := make([]string, len(values))
+	for i, v := range values {
+		var err error
+		if str[i], err = formatValue(v); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(str, ","), nil
+}
+
+// formatValue write a value for the simple query language. Strings are quoted so the broker never compare them as
+// numbers.
+func formatValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		if err := checkString(v); err != nil {
+			return "", err
+		}
+		return "'" + v + "'", nil
+	case float64:
+		return formatFloat(v), nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// checkString reject the strings that can't be written in the simple query language.
+func checkString(v string) error {
+	if strings.ContainsAny(v, "';") {
+		return fmt.Errorf("query value %q contains ' or ;", v)
+	}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("id", strings.Join(q.ID, ","))
+	set("idPattern", q.IDPattern)
+	set("type", strings.Join(q.Type, ","))
+	set("typePattern", q.TypePattern)
+	set("q", q.Q.String())
+	set("mq", q.MQ.String())
+	set("attrs", strings.Join(q.Attrs, ","))
+	set("orderBy", strings.Join(q.OrderBy, ","))
+	if q.Geo != nil {
+		set("georel", q.Geo.Georel)
+		set("geometry", q.Geo.Geometry)
+		set("coords", q.Geo.Coords)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	v.Set("limit", strconv.Itoa(limit))
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	options := []string{"count"}
+	if q.Options != Normalized {
+		options = append(options, string(q.Options))
+	}
+	v.Set("options", strings.Join(options, ","))
+	return v
+}
+
+// QueryEntities return the page of entities selected by q and the total number of entities matching q.
+func (c *Client) QueryEntities(ctx log.Interface, q Query) ([]Entity, int, error) {
+	if err := q.Q.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid q")
+	}
+	if err := q.MQ.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid mq")
+	}
+	resp, buff, err := c.exchange(ctx, entities+"?"+q.values().Encode(), "GET", nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to query entities")
+	}
+	ents, err := q.decode(buff)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to parse entities")
+	}
+	total, err := strconv.Atoi(resp.Header.Get("Fiware-Total-Count"))
+	if err != nil {
+		total = q.Offset + len(ents)
+	}
+	return ents, total, nil
+}
+
+func (q Query) decode(buff []byte) ([]Entity, error) {
+	switch q.Options {
+	case Values:
+		var rows [][]interface{}
+		if err := json.Unmarshal(buff, &rows); err != nil {
+			return nil, err
+		}
+		ents := make([]Entity, len(rows))
+		for i, row := range rows {
+			if len(row) != len(q.Attrs) {
+				return nil, fmt.Errorf("got %d values for %d attrs", len(row), len(q.Attrs))
+			}
+			kv := make(map[string]interface{}, len(row))
+			for j, attr := range q.Attrs {
+				kv[attr] = row[j]
+			}
+			ents[i] = fromValues(kv)
+		}
+		return ents, nil
+	default:
+		var raws []json.RawMessage
+		if err := json.Unmarshal(buff, &raws); err != nil {
+			return nil, err
+		}
+		ents := make([]Entity, len(raws))
+		for i, raw := range raws {
+			if err := ents[i].decode(raw, q.Options); err != nil {
+				return nil, err
+			}
+		}
+		return ents, nil
+	}
+}
+
+// fromValues build an entity from the values of its attributes, attribute types are left empty.
+func fromValues(kv map[string]interface{}) Entity {
+	e := Entity{Attributes: make(map[string]Attribute)}
+	for k, v := range kv {
+		switch k {
+		case "id":
+			e.Id, _ = v.(string)
+		case "type":
+			e.Type, _ = v.(string)
+		default:
+			e.Attributes[k] = Attribute{AttrPair: AttrPair{Value: v}}
+		}
+	}
+	return e
+}
+
+// EntityIterator walk through all the pages of a query. Call Next until it return false, then check Err.
+type EntityIterator struct {
+	ctx    log.Interface
+	client *Client
+	query  Query
+	page   []Entity
+	pos    int
+	total  int
+	done   bool
+	err    error
+}
+
+// Entities return an iterator over every entity matching q, starting at q.Offset. q.Limit is the page size.
+func (c *Client) Entities(ctx log.Interface, q Query) *EntityIterator {
+	return &EntityIterator{
+		ctx:    ctx,
+		client: c,
+		query:  q,
+	}
+}
+
+// Next move to the next entity, fetching the next page when needed. It return false at the end of the results or on
+// error.
+func (it *EntityIterator) Next() bool {
+	if it.pos+1 < len(it.page) {
+		it.pos++
+		return true
+	}
+	if it.done {
+		return false
+	}
+	if it.page != nil {
+		it.query.Offset += len(it.page)
+	}
+	it.page, it.total, it.err = it.client.QueryEntities(it.ctx, it.query)
+	it.pos = 0
+	it.done = it.err != nil || len(it.page) == 0 || it.query.Offset+len(it.page) >= it.total
+	return len(it.page) > 0
+}
+
+// Entity return the current entity.
+func (it *EntityIterator) Entity() Entity {
+	return it.page[it.pos]
+}
+
+// Total return the number of entities matching the query, known after the first call to Next.
+func (it *EntityIterator) Total() int {
+	return it.total
+}
+
+// Err return the error that stopped the iteration.
+func (it *EntityIterator) Err() error {
+	return it.err
+}
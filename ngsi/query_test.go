@@ -0,0 +1,73 @@
+package ngsi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestQueryValues(t *testing.T) {
+	a := assertions.New(t)
+	q := Query{
+		Type:    []string{"WaterTank"},
+		Q:       SQ{}.Greater("waterlevel", 1.5).Equal("status", "open", "closed").Exists("temp1"),
+		MQ:      SQ{}.Less("waterlevel.accuracy", 0.1),
+		Attrs:   []string{"waterlevel"},
+		OrderBy: []string{"!waterlevel"},
+		Geo:     Near(52.37, 4.89, 1000),
+		Options: KeyValues,
+	}
+	v := q.values()
+	a.So(v.Get("type"), assertions.ShouldEqual, "WaterTank")
+	a.So(v.Get("q"), assertions.ShouldEqual, "waterlevel>1.5;status=='open','closed';temp1")
+	a.So(v.Get("mq"), assertions.ShouldEqual, "waterlevel.accuracy<0.1")
+	a.So(v.Get("georel"), assertions.ShouldEqual, "near;maxDistance:1000")
+	a.So(v.Get("coords"), assertions.ShouldEqual, "52.37,4.89")
+	a.So(v.Get("limit"), assertions.ShouldEqual, "100")
+	a.So(v.Get("options"), assertions.ShouldEqual, "count,keyValues")
+	a.So(v.Get("offset"), assertions.ShouldEqual, "")
+	a.So(q.Q.Err(), assertions.ShouldBeNil)
+
+	q = Query{Q: SQ{}.Equal("status", "x';level>0").Exists("temp1")}
+	a.So(q.Q.Err(), assertions.ShouldNotBeNil)
+	a.So(q.Q.String(), assertions.ShouldEqual, "temp1")
+	a.So(SQ{}.Between("level", 1.0, "2;3").Err(), assertions.ShouldNotBeNil)
+	_, _, err := NewClient("http://localhost:1").QueryEntities(log.Get(), q)
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestEntityIterator(t *testing.T) {
+	a := assertions.New(t)
+	const total = 5
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		w.Header().Set("Fiware-Total-Count", strconv.Itoa(total))
+		fmt.Fprint(w, "[")
+		for i := offset; i < offset+limit && i < total; i++ {
+			if i > offset {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"id":"tank%d","type":"WaterTank","waterlevel":%d}`, i, i)
+		}
+		fmt.Fprint(w, "]")
+	}))
+	defer srv.Close()
+
+	it := NewClient(srv.URL).Entities(log.Get(), Query{Limit: 2, Options: KeyValues})
+	var ids []string
+	for it.Next() {
+		ent := it.Entity()
+		a.So(ent.Type, assertions.ShouldEqual, "WaterTank")
+		a.So(ent.Attributes["waterlevel"].Value, assertions.ShouldEqual, float64(len(ids)))
+		ids = append(ids, ent.Id)
+	}
+	a.So(it.Err(), assertions.ShouldBeNil)
+	a.So(it.Total(), assertions.ShouldEqual, total)
+	a.So(ids, assertions.ShouldResemble, []string{"tank0", "tank1", "tank2", "tank3", "tank4"})
+}
@@ -5,32 +5,235 @@ package ngsi
 import (
 	"bytes"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
 )
 
-func request(brokerURL, method string, elem interface{}) ([]byte, error) {
-	req, err := prepareRequest(brokerURL, method, elem)
+// DefaultTimeout is the time allowed to a broker request, including reading the response body.
+const DefaultTimeout = 10 * time.Second
+
+// metrics count the broker requests on /debug/vars.
+var metrics = expvar.NewMap("ngsi_requests")
+
+// RetryPolicy define how a failed request is retried. The wait between two attempts grow exponentially from Backoff
+// up to MaxBackoff with a random jitter. A Retry-After header longer than MaxBackoff stop the retries.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry is the retry policy of a client returned by NewClient.
+var DefaultRetry = RetryPolicy{
+	Attempts:   3,
+	Backoff:    200 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// Client send requests to a NGSI v2 broker. Tokens is optional, when set its token is sent in the AuthHeader header
+// (X-Auth-Token by default, as expected by a Wilma PEP proxy). Breaker is optional, when set the client fail fast
+// while the broker is unhealthy. Headers are added to every request, like the Fiware-Service tenant headers.
+type Client struct {
+	URL        string
+	Tokens     TokenSource
+	AuthHeader string
+	Headers    http.Header
+	HTTP       *http.Client
+	Retry      RetryPolicy
+	Breaker    *Breaker
+}
+
+// NewClient return a client for the broker at brokerURL without credentials, with the default timeout and retry
+// policy.
+func NewClient(brokerURL string) *Client {
+	return &Client{
+		URL:   brokerURL,
+		HTTP:  &http.Client{Timeout: DefaultTimeout},
+		Retry: DefaultRetry,
+	}
+}
+
+// Send send elem, as JSON, to path with method and return the response body. It is used for the endpoints that
+// have no method of their own, like webhooks.
+func (c *Client) Send(ctx log.Interface, method, path string, elem interface{}) ([]byte, error) {
+	return c.request(ctx, path, method, elem)
+}
+
+// request send elem to the broker path and return the response body. Failed requests are retried according to the
+// client retry policy, see retryable.
+func (c *Client) request(ctx log.Interface, path, method string, elem interface{}) ([]byte, error) {
+	_, buff, err := c.exchange(ctx, path, method, elem)
+	return buff, err
+}
+
+// exchange is request returning the broker response as well, its body is already read.
+func (c *Client) exchange(ctx log.Interface, path, method string, elem interface{}) (*http.Response, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		if c.Breaker != nil {
+			if err := c.Breaker.Allow(ctx); err != nil {
+				metrics.Add("breaker_rejected", 1)
+				return nil, nil, err
+			}
+		}
+		metrics.Add("sent", 1)
+		resp, buff, err := c.send(path, method, elem)
+		if c.Breaker != nil {
+			c.Breaker.Report(ctx, err == nil && resp.StatusCode < 500)
+		}
+		if err == nil && resp.StatusCode < 300 {
+			return resp, buff, nil
+		}
+		if err == nil {
+			err = newError(resp, buff)
+		}
+		wait, retry := c.Retry.next(attempt, retryable(method, path, err), resp)
+		if !retry {
+			metrics.Add("failed", 1)
+			return resp, buff, err
+		}
+		metrics.Add("retried", 1)
+		ctx.WithFields(log.Fields{"attempt": attempt, "wait": wait}).WithError(err).Debug("Retrying broker request")
+		time.Sleep(wait)
+	}
+}
+
+// send do a single request. If the broker answer 401 the token is invalidated and the request is sent once more with
+// a fresh token.
+func (c *Client) send(path, method string, elem interface{}) (*http.Response, []byte, error) {
+	resp, buff, err := c.do(path, method, elem)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.Tokens != nil {
+		c.Tokens.Invalidate()
+		resp, buff, err = c.do(path, method, elem)
+	}
+	return resp, buff, err
+}
+
+func (c *Client) do(path, method string, elem interface{}) (*http.Response, []byte, error) {
+	req, err := prepareRequest(c.URL+path, method, elem)
 	if err != nil {
-		return nil, fmt.Errorf("ngsi prepare request failed: %s", err)
+		return nil, nil, fmt.Errorf("ngsi prepare request failed: %s", err)
+	}
+	for name, values := range c.Headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if err = c.authenticate(req); err != nil {
+		return nil, nil, fmt.Errorf("ngsi authentication failed: %s", err)
+	}
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 	buff, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode > 299 {
-		if err != nil {
-			return nil, err
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, buff, nil
+}
+
+func (c *Client) authenticate(req *http.Request) error {
+	if c.Tokens == nil {
+		return nil
+	}
+	token, err := c.Tokens.Token()
+	if err != nil {
+		return err
+	}
+	header := c.AuthHeader
+	if header == "" {
+		header = "X-Auth-Token"
+	}
+	if strings.EqualFold(header, "Authorization") {
+		token = "Bearer " + token
+	}
+	req.Header.Set(header, token)
+	return nil
+}
+
+// retryable tell if a failed request can be sent again. 429 and 503 mean the broker didn't process the request so
+// they are always retried. Other server and network errors are only retried for idempotent operations.
+func retryable(method, path string, err error) bool {
+	if status := StatusCode(err); status != 0 {
+		switch {
+		case status == http.StatusTooManyRequests, status == http.StatusServiceUnavailable:
+			return true
+		case status < 500:
+			return false
 		}
-		return buff, fmt.Errorf("request failed requestURL=%v code=%v body=%v", req.URL, resp.StatusCode, string(buff))
 	}
-	return buff, err
+	return idempotent(method, path)
 }
 
-// prepareRequest prepare a request to be sent to the IoT broker. JSON content-type/
+// idempotent tell if sending the same request twice has the same effect as sending it once. Appending attributes to
+// an entity and upserting NGSI-LD entities are POST but overwrite the same values when repeated.
+func idempotent(method, path string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "PATCH", "DELETE":
+		return true
+	case "POST":
+		path = strings.SplitN(path, "?", 2)[0]
+		return strings.HasSuffix(path, "/attrs") || strings.HasSuffix(path, "/upsert")
+	}
+	return false
+}
+
+// next return how long to wait before the attempt following attempt, and false if there must be no other attempt.
+func (p RetryPolicy) next(attempt int, retry bool, resp *http.Response) (time.Duration, bool) {
+	if !retry || attempt >= p.Attempts {
+		return 0, false
+	}
+	wait := p.Backoff << uint(attempt-1)
+	if wait <= 0 || wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+	if resp != nil {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if after > p.MaxBackoff {
+				return 0, false
+			}
+			if after > wait {
+				wait = after
+			}
+		}
+	}
+	return wait, true
+}
+
+// retryAfter parse a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(header); err == nil {
+		return time.Duration(sec) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// prepareRequest prepare a request to be sent to the IoT broker. JSON content-type/ A nil message is sent without
+// body.
 func prepareRequest(uri string, method string, message interface{}) (*http.Request, error) {
+	if message == nil {
+		return http.NewRequest(method, uri, nil)
+	}
 	var body []byte
 	var err error
 	body, err = json.Marshal(message)
@@ -91,7 +91,7 @@ func notificationLog(ctx log.Interface) gin.HandlerFunc {
 	}
 }
 
-func SubscribeEntityType(ctx log.Interface, brokerURL, downURL, entityType string, attrs []string) (string, error) {
+func (c *Client) SubscribeEntityType(ctx log.Interface, downURL, entityType string, attrs []string) (string, error) {
 	ctx.Infof("Subscribing to entity type %s on attribute %v", entityType, attrs)
 	sub := Subscription{
 		Description: fmt.Sprintf("Subscription for %s on attrs %v", entityType, attrs),
@@ -118,7 +118,7 @@ func SubscribeEntityType(ctx log.Interface, brokerURL, downURL, entityType strin
 
 	var body []byte
 	var err error
-	if body, err = request(brokerURL+subscription, "POST", sub); err != nil {
+	if body, err = c.request(ctx, subscription, "POST", sub); err != nil {
 		return "", err
 	}
 	fmt.Println(string(body))
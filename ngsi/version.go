@@ -0,0 +1,24 @@
+package ngsi
+
+import (
+	"encoding/json"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+const version = "/version"
+
+// Version return the version document of the broker, Orion answer it under the orion key. It is used to check the
+// broker is reachable.
+func (c *Client) Version(ctx log.Interface) (map[string]interface{}, error) {
+	buff, err := c.request(ctx, version, "GET", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get broker version")
+	}
+	v := map[string]interface{}{}
+	if err = json.Unmarshal(buff, &v); err != nil {
+		return nil, errors.Wrap(err, "invalid broker version")
+	}
+	return v, nil
+}
@@ -0,0 +1,197 @@
+package bridges
+
+import "fmt"
+
+// BinaryField describe a value of a binary payload. Length is in bytes, up to 8, and the value is big endian unless
+// Endian is little. Bits select Bits bits of the integer starting at bit Bit, 0 being the least significant bit, a
+// single bit being decoded as a boolean. The integer is multiplied by Scale when it is set.
+type BinaryField struct {
+	Name   string  `json:"name"`
+	Offset int     `json:"offset"`
+	Length int     `json:"length"`
+	Endian string  `json:"endian,omitempty" yaml:",omitempty"`
+	Signed bool    `json:"signed,omitempty" yaml:",omitempty"`
+	Scale  float64 `json:"scale,omitempty" yaml:",omitempty"`
+	Bit    int     `json:"bit,omitempty" yaml:",omitempty"`
+	Bits   int     `json:"bits,omitempty" yaml:",omitempty"`
+}
+
+// decodeBinary read the fields of opts.Layout in a binary payload.
+func decodeBinary(data []byte, opts SchemaData) (map[string]interface{}, error) {
+	msg := make(map[string]interface{}, len(opts.Layout))
+	for _, f := range opts.Layout {
+		v, err := f.decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name, err)
+		}
+		msg[f.Name] = v
+	}
+	return msg, nil
+}
+
+func (f BinaryField) decode(data []byte) (interface{}, error) {
+	if f.Offset+f.Length > len(data) {
+		return nil, fmt.Errorf("payload of %d bytes too short", len(data))
+	}
+	u := readUint(data[f.Offset:f.Offset+f.Length], f.Endian == "little")
+	width := uint(f.Length * 8)
+	if f.Bits > 0 {
+		u = u >> uint(f.Bit) & (1<<uint(f.Bits) - 1)
+		width = uint(f.Bits)
+		if f.Bits == 1 && !f.Signed && f.Scale == 0 {
+			return u == 1, nil
+		}
+	}
+	v := float64(u)
+	if f.Signed {
+		v = float64(signExtend(u, width))
+	}
+	if f.Scale != 0 {
+		v *= f.Scale
+	}
+	return v, nil
+}
+
+// readUint read an unsigned integer of up to 8 bytes.
+func readUint(b []byte, little bool) uint64 {
+	var u uint64
+	for i := range b {
+		if little {
+			u = u<<8 | uint64(b[len(b)-1-i])
+		} else {
+			u = u<<8 | uint64(b[i])
+		}
+	}
+	return u
+}
+
+// signExtend read the two's complement integer of width bits held in u.
+func signExtend(u uint64, width uint) int64 {
+	if width < 64 && u&(1<<(width-1)) != 0 {
+		return int64(u) - 1<<width
+	}
+	return int64(u)
+}
+
+// check return the problems of the field.
+func (f BinaryField) check() []string {
+	var msgs []string
+	if f.Name == "" {
+		msgs = append(msgs, "layout field without name")
+	}
+	if f.Offset < 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: negative offset", f.Name))
+	}
+	if f.Length < 1 || f.Length > 8 {
+		msgs = append(msgs, fmt.Sprintf("%s: length must be between 1 and 8 bytes", f.Name))
+	}
+	if f.Endian != "" && f.Endian != "big" && f.Endian != "little" {
+		msgs = append(msgs, fmt.Sprintf("%s: unknown endianness %q", f.Name, f.Endian))
+	}
+	if f.Bit < 0 || f.Bits < 0 || f.Bit+f.Bits > f.Length*8 || f.Bit > 0 && f.Bits == 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: bits %d to %d out of the %d bytes value", f.Name, f.Bit, f.Bit+f.Bits, f.Length))
+	}
+	return msgs
+}
+
+// lppType is a Cayenne LPP data type: its name, size and the divisor of its values. Values made of several numbers
+// have one name per number.
+type lppType struct {
+	name    string
+	size    int
+	signed  bool
+	divisor float64
+	values  []string
+}
+
+// lppTypes are the Cayenne LPP data types, named like the TTN Cayenne LPP payload format.
+var lppTypes = map[byte]lppType{
+	0:   {name: "digital_in", size: 1, divisor: 1},
+	1:   {name: "digital_out", size: 1, divisor: 1},
+	2:   {name: "analog_in", size: 2, signed: true, divisor: 100},
+	3:   {name: "analog_out", size: 2, signed: true, divisor: 100},
+	100: {name: "generic", size: 4, divisor: 1},
+	101: {name: "luminosity", size: 2, divisor: 1},
+	102: {name: "presence", size: 1, divisor: 1},
+	103: {name: "temperature", size: 2, signed: true, divisor: 10},
+	104: {name: "relative_humidity", size: 1, divisor: 2},
+	113: {name: "accelerometer", size: 2, signed: true, divisor: 1000, values: []string{"x", "y", "z"}},
+	115: {name: "barometric_pressure", size: 2, divisor: 10},
+	116: {name: "voltage", size: 2, divisor: 100},
+	117: {name: "current", size: 2, divisor: 1000},
+	118: {name: "frequency", size: 4, divisor: 1},
+	120: {name: "percentage", size: 1, divisor: 1},
+	121: {name: "altitude", size: 2, signed: true, divisor: 1},
+	125: {name: "concentration", size: 2, divisor: 1},
+	128: {name: "power", size: 2, divisor: 1},
+	130: {name: "distance", size: 4, divisor: 1000},
+	131: {name: "energy", size: 4, divisor: 1000},
+	132: {name: "direction", size: 2, divisor: 1},
+	133: {name: "unixtime", size: 4, divisor: 1},
+	134: {name: "gyrometer", size: 2, signed: true, divisor: 100, values: []string{"x", "y", "z"}},
+	142: {name: "switch", size: 1, divisor: 1},
+}
+
+// lppGPS is the GPS location type, its numbers have different divisors.
+const lppGPS = 136
+
+// decodeLPP read a Cayenne LPP payload. Every value is named by its type and channel, like temperature_1, values made
+// of several numbers are objects.
+func decodeLPP(data []byte, opts SchemaData) (map[string]interface{}, error) {
+	msg := make(map[string]interface{})
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated LPP value")
+		}
+		channel, code := data[0], data[1]
+		data = data[2:]
+		var name string
+		var v interface{}
+		if code == lppGPS {
+			if len(data) < 9 {
+				return nil, fmt.Errorf("truncated LPP gps value on channel %d", channel)
+			}
+			name = "gps"
+			v = map[string]interface{}{
+				"latitude":  lppNumber(data[0:3], true, 10000),
+				"longitude": lppNumber(data[3:6], true, 10000),
+				"altitude":  lppNumber(data[6:9], true, 100),
+			}
+			data = data[9:]
+		} else {
+			t, ok := lppTypes[code]
+			if !ok {
+				return nil, fmt.Errorf("unknown LPP type %d on channel %d", code, channel)
+			}
+			n := len(t.values)
+			if n == 0 {
+				n = 1
+			}
+			if len(data) < n*t.size {
+				return nil, fmt.Errorf("truncated LPP %s value on channel %d", t.name, channel)
+			}
+			name = t.name
+			if t.values == nil {
+				v = lppNumber(data[:t.size], t.signed, t.divisor)
+			} else {
+				values := make(map[string]interface{}, n)
+				for i, k := range t.values {
+					values[k] = lppNumber(data[i*t.size:(i+1)*t.size], t.signed, t.divisor)
+				}
+				v = values
+			}
+			data = data[n*t.size:]
+		}
+		msg[fmt.Sprintf("%s_%d", name, channel)] = v
+	}
+	return msg, nil
+}
+
+// lppNumber decode a big endian number.
+func lppNumber(b []byte, signed bool, divisor float64) float64 {
+	u := readUint(b, false)
+	if signed {
+		return float64(signExtend(u, uint(len(b)*8))) / divisor
+	}
+	return float64(u) / divisor
+}
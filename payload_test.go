@@ -0,0 +1,57 @@
+package bridges
+
+import (
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestDecodeLPP(t *testing.T) {
+	a := assertions.New(t)
+	msg, err := decodeLPP([]byte{
+		0x03, 0x67, 0xff, 0x38, // temperature -20.0
+		0x05, 0x68, 0x61, // humidity 48.5
+		0x06, 0x71, 0x04, 0xd2, 0xfb, 0x2e, 0x00, 0x00, // accelerometer 1.234, -1.234, 0
+		0x01, 0x88, 0x06, 0x76, 0x5f, 0xf2, 0x96, 0x0a, 0x00, 0x03, 0xe8, // gps 42.3519, -87.9094, 10
+	}, SchemaData{})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(msg, assertions.ShouldResemble, map[string]interface{}{
+		"temperature_3":       -20.0,
+		"relative_humidity_5": 48.5,
+		"accelerometer_6":     map[string]interface{}{"x": 1.234, "y": -1.234, "z": 0.0},
+		"gps_1":               map[string]interface{}{"latitude": 42.3519, "longitude": -87.9094, "altitude": 10.0},
+	})
+
+	_, err = decodeLPP([]byte{0x01, 0x67, 0x01}, SchemaData{})
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = decodeLPP([]byte{0x01, 0x42, 0x01}, SchemaData{})
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestDecodeBinary(t *testing.T) {
+	a := assertions.New(t)
+	layout := []BinaryField{
+		{Name: "level", Offset: 0, Length: 4, Endian: "little", Scale: 0.5},
+		{Name: "temp", Offset: 4, Length: 2, Signed: true},
+		{Name: "mode", Offset: 6, Length: 1, Bit: 1, Bits: 3},
+		{Name: "offset", Offset: 6, Length: 1, Bit: 4, Bits: 3, Signed: true},
+		{Name: "valve", Offset: 6, Length: 1, Bit: 7, Bits: 1},
+	}
+	msg, err := decodeBinary([]byte{0x10, 0x00, 0x00, 0x00, 0xff, 0xfe, 0xe6}, SchemaData{Layout: layout})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(msg, assertions.ShouldResemble, map[string]interface{}{
+		"level":  8.0,
+		"temp":   -2.0,
+		"mode":   3.0,
+		"offset": -2.0,
+		"valve":  true,
+	})
+
+	_, err = decodeBinary([]byte{0x10}, SchemaData{Layout: layout})
+	a.So(err, assertions.ShouldNotBeNil)
+
+	a.So(BinaryField{Name: "level", Length: 9}.check(), assertions.ShouldHaveLength, 1)
+	a.So(BinaryField{Name: "level", Length: 1, Bit: 6, Bits: 3}.check(), assertions.ShouldHaveLength, 1)
+	a.So(BinaryField{Name: "level", Length: 2, Endian: "middle"}.check(), assertions.ShouldHaveLength, 1)
+	a.So(BinaryField{Name: "level", Length: 2, Bit: 8, Bits: 8}.check(), assertions.ShouldBeEmpty)
+}
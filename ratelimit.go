@@ -0,0 +1,198 @@
+package bridges
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits checked by a RateLimiter, they name the reason of the rejected messages.
+const (
+	LimitGlobal = "global"
+	LimitSchema = "schema"
+	LimitEntity = "entity"
+	LimitClient = "client"
+)
+
+// pruneEvery is the number of checks between two removals of the idle buckets.
+const pruneEvery = 1000
+
+// rateLimited count the messages rejected by reason.
+var rateLimited = expvar.NewMap("rate_limited")
+
+// Rate is a token bucket: Count messages every Per, with bursts of Burst messages. The zero Rate is unlimited.
+type Rate struct {
+	Count float64
+	Per   time.Duration
+	Burst float64
+}
+
+// ParseRate read a rate written count/duration, like 10/1s or 60/m, optionally followed by :burst like 60/m:10.
+// The burst is the count by default and an empty string is unlimited.
+func ParseRate(s string) (Rate, error) {
+	if s == "" {
+		return Rate{}, nil
+	}
+	str, burst := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		str, burst = s[:i], s[i+1:]
+	}
+	split := strings.SplitN(str, "/", 2)
+	if len(split) != 2 {
+		return Rate{}, fmt.Errorf("invalid rate %q, use count/duration like 10/1s", s)
+	}
+	var r Rate
+	var err error
+	if r.Count, err = strconv.ParseFloat(split[0], 64); err != nil || r.Count <= 0 {
+		return Rate{}, fmt.Errorf("invalid count in rate %q", s)
+	}
+	per := split[1]
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	if r.Per, err = time.ParseDuration(per); err != nil || r.Per <= 0 {
+		return Rate{}, fmt.Errorf("invalid duration in rate %q", s)
+	}
+	r.Burst = r.Count
+	if burst != "" {
+		if r.Burst, err = strconv.ParseFloat(burst, 64); err != nil || r.Burst < 1 {
+			return Rate{}, fmt.Errorf("invalid burst in rate %q", s)
+		}
+	}
+	return r, nil
+}
+
+func (r Rate) unlimited() bool {
+	return r.Count == 0
+}
+
+// perSecond return the tokens added to the bucket every second.
+func (r Rate) perSecond() float64 {
+	return r.Count / r.Per.Seconds()
+}
+
+// SchemaLimit override the rates of the RateLimiter for the messages of a schema: Schema limit all the messages of
+// the schema key and Entity the messages of each entity, like 1/10s.
+type SchemaLimit struct {
+	Schema string `json:"schema,omitempty" yaml:",omitempty"`
+	Entity string `json:"entity,omitempty" yaml:",omitempty"`
+}
+
+// check return the problems of the limit settings.
+func (l *SchemaLimit) check() []pathDiagnostic {
+	var diags []pathDiagnostic
+	if _, err := ParseRate(l.Schema); err != nil {
+		diags = append(diags, errorAt(err.Error(), "limit", "schema"))
+	}
+	if _, err := ParseRate(l.Entity); err != nil {
+		diags = append(diags, errorAt(err.Error(), "limit", "entity"))
+	}
+	return diags
+}
+
+// RateLimiter limit the messages with token buckets: one for all the messages, one by schema key, one by entity ID
+// and one by client. Unlimited rates are not checked.
+type RateLimiter struct {
+	Global Rate
+	Schema Rate
+	Entity Rate
+	Client Rate
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	checks  int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   Rate
+}
+
+// refill add the tokens earned since the last refill.
+func (b *bucket) refill(at time.Time) {
+	b.tokens = math.Min(b.rate.Burst, b.tokens+at.Sub(b.last).Seconds()*b.rate.perSecond())
+	b.last = at
+}
+
+type limitCheck struct {
+	reason, key string
+	rate        Rate
+}
+
+// Allow tell if a message of the schema key for the entity id, sent by client, is within the limits. Otherwise it
+// return the reason of the first limit exceeded and how long to wait before retrying, and the message is counted.
+// Messages from the bridges without client use an empty one.
+func (l *RateLimiter) Allow(key string, sch *Schema, id, client string) (string, time.Duration) {
+	if l == nil {
+		return "", 0
+	}
+	schema, entity := l.Schema, l.Entity
+	if sch != nil && sch.Limit != nil {
+		// Invalid rates are reported by Validate, they keep the default ones.
+		if r, err := ParseRate(sch.Limit.Schema); err == nil && sch.Limit.Schema != "" {
+			schema = r
+		}
+		if r, err := ParseRate(sch.Limit.Entity); err == nil && sch.Limit.Entity != "" {
+			entity = r
+		}
+	}
+	checks := []limitCheck{
+		{LimitGlobal, "", l.Global},
+		{LimitClient, client, l.Client},
+		{LimitSchema, key, schema},
+		{LimitEntity, key + "\x00" + id, entity},
+	}
+	if client == "" {
+		checks[1].rate = Rate{}
+	}
+	at := now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	if l.checks++; l.checks%pruneEvery == 0 {
+		l.prune(at)
+	}
+	buckets := make([]*bucket, 0, len(checks))
+	for _, c := range checks {
+		if c.rate.unlimited() {
+			continue
+		}
+		b := l.bucket(c.reason+"\x00"+c.key, c.rate, at)
+		if b.tokens < 1 {
+			rateLimited.Add(c.reason, 1)
+			return c.reason, time.Duration((1 - b.tokens) / b.rate.perSecond() * float64(time.Second))
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return "", 0
+}
+
+// bucket return the bucket of key, full when it is new or its rate changed.
+func (l *RateLimiter) bucket(key string, rate Rate, at time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = &bucket{tokens: rate.Burst, last: at, rate: rate}
+		l.buckets[key] = b
+	}
+	b.refill(at)
+	return b
+}
+
+// prune remove the buckets that are full again, they are the same as new ones.
+func (l *RateLimiter) prune(at time.Time) {
+	for key, b := range l.buckets {
+		if b.refill(at); b.tokens >= b.rate.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
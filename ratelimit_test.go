@@ -0,0 +1,67 @@
+package bridges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestParseRate(t *testing.T) {
+	a := assertions.New(t)
+	r, err := ParseRate("60/m:10")
+	a.So(err, assertions.ShouldBeNil)
+	a.So(r, assertions.ShouldResemble, Rate{Count: 60, Per: time.Minute, Burst: 10})
+	r, err = ParseRate("5/10s")
+	a.So(err, assertions.ShouldBeNil)
+	a.So(r, assertions.ShouldResemble, Rate{Count: 5, Per: 10 * time.Second, Burst: 5})
+	r, err = ParseRate("")
+	a.So(err, assertions.ShouldBeNil)
+	a.So(r.unlimited(), assertions.ShouldBeTrue)
+	for _, s := range []string{"10", "x/s", "10/x", "0/s", "10/s:0"} {
+		_, err = ParseRate(s)
+		a.So(err, assertions.ShouldNotBeNil)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	a := assertions.New(t)
+	at := time.Date(2019, 1, 16, 16, 0, 0, 0, time.UTC)
+	now = func() time.Time { return at }
+	defer func() { now = time.Now }()
+
+	l := &RateLimiter{Entity: Rate{Count: 1, Per: time.Second, Burst: 2}, Client: Rate{Count: 3, Per: time.Second, Burst: 3}}
+	sch := &Schema{}
+	allow := func(key, id, client string) string {
+		reason, _ := l.Allow(key, sch, id, client)
+		return reason
+	}
+	a.So(allow("particle", "tank-1", ""), assertions.ShouldEqual, "")
+	a.So(allow("particle", "tank-1", ""), assertions.ShouldEqual, "")
+	reason, wait := l.Allow("particle", sch, "tank-1", "")
+	a.So(reason, assertions.ShouldEqual, LimitEntity)
+	a.So(wait, assertions.ShouldEqual, time.Second)
+	a.So(allow("ttn", "tank-1", ""), assertions.ShouldEqual, "")
+
+	at = at.Add(500 * time.Millisecond)
+	reason, wait = l.Allow("particle", sch, "tank-1", "")
+	a.So(reason, assertions.ShouldEqual, LimitEntity)
+	a.So(wait, assertions.ShouldEqual, 500*time.Millisecond)
+	at = at.Add(500 * time.Millisecond)
+	a.So(allow("particle", "tank-1", ""), assertions.ShouldEqual, "")
+
+	for _, id := range []string{"tank-2", "tank-3", "tank-2"} {
+		a.So(allow("particle", id, "10.0.0.1"), assertions.ShouldEqual, "")
+	}
+	a.So(allow("particle", "tank-3", "10.0.0.1"), assertions.ShouldEqual, LimitClient)
+	a.So(allow("particle", "tank-3", "10.0.0.2"), assertions.ShouldEqual, "")
+
+	sch.Limit = &SchemaLimit{Schema: "1/m"}
+	a.So(allow("slow", "tank-4", ""), assertions.ShouldEqual, "")
+	a.So(allow("slow", "tank-5", ""), assertions.ShouldEqual, LimitSchema)
+	a.So((&SchemaLimit{Entity: "often"}).check(), assertions.ShouldHaveLength, 1)
+
+	var unlimited *RateLimiter
+	reason, _ = unlimited.Allow("particle", sch, "tank-1", "")
+	a.So(reason, assertions.ShouldEqual, "")
+}
@@ -0,0 +1,310 @@
+package bridges
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Device hold what the bridge know about a device without reading it in its messages: static attributes added to its
+// entity when the message doesn't set them, metadata added to its attributes and parameters of the computed
+// attributes, overriding the schema ones.
+type Device struct {
+	Attrs    map[string]ngsi.AttrPair            `json:"attrs,omitempty" yaml:",omitempty"`
+	Metadata map[string]map[string]ngsi.AttrPair `json:"metadata,omitempty" yaml:",omitempty"`
+	Params   map[string]interface{}              `json:"params,omitempty" yaml:",omitempty"`
+}
+
+// Registry hold the devices by entity ID. It is read from a YAML file mapping the IDs to devices, or a CSV file, see
+// ParseDevicesCSV.
+type Registry struct {
+	mu      sync.RWMutex
+	devices map[string]*Device
+	file    string
+	modTime time.Time
+}
+
+// NewRegistry return a registry with the given devices and no backing file.
+func NewRegistry(devices map[string]*Device) *Registry {
+	if devices == nil {
+		devices = map[string]*Device{}
+	}
+	return &Registry{devices: devices}
+}
+
+// LoadRegistry read the devices from a YAML or CSV file, depending on its extension.
+func LoadRegistry(filename string) (*Registry, error) {
+	r := &Registry{file: filename}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get return the device of the entity id. A nil registry has no device.
+func (r *Registry) Get(id string) (*Device, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	dev, ok := r.devices[id]
+	return dev, ok
+}
+
+// All return the devices by entity ID. The map must not be modified.
+func (r *Registry) All() map[string]*Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.devices
+}
+
+// Reload read the registry file again. The current devices are kept if the file is invalid.
+func (r *Registry) Reload() error {
+	if r.file == "" {
+		return fmt.Errorf("registry has no file")
+	}
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return err
+	}
+	buff, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	var devices map[string]*Device
+	switch strings.ToLower(filepath.Ext(r.file)) {
+	case ".csv":
+		devices, err = ParseDevicesCSV(bytes.NewReader(buff))
+	default:
+		devices, err = ParseDevices(buff)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTime = info.ModTime()
+	if err != nil {
+		return fmt.Errorf("invalid registry file %s: %s", r.file, err)
+	}
+	r.devices = devices
+	return nil
+}
+
+func (r *Registry) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modified(r.file, r.modTime)
+}
+
+// Watch reload the registry file when it is modified, checking every interval, or when the process receive SIGHUP.
+// It return a function stopping the watch.
+func (r *Registry) Watch(ctx log.Interface, interval time.Duration) func() {
+	return watchFile(ctx.WithField("registry", r.file), interval, r.changed, r.Reload, "devices")
+}
+
+// ParseDevices decode the devices of a YAML registry file strictly and check them.
+func ParseDevices(buff []byte) (map[string]*Device, error) {
+	devices := map[string]*Device{}
+	if err := yaml.UnmarshalStrict(buff, &devices); err != nil {
+		return nil, err
+	}
+	for id, dev := range devices {
+		if dev == nil {
+			devices[id] = &Device{}
+			continue
+		}
+		// YAML decode nested objects with interface keys, they are turned into JSON objects.
+		for k, v := range dev.Params {
+			dev.Params[k] = jsonValue(v)
+		}
+		for name, attr := range dev.Attrs {
+			attr.Value = jsonValue(attr.Value)
+			dev.Attrs[name] = attr
+		}
+	}
+	if err := checkDevices(devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// ParseDevicesCSV read the devices of a CSV registry file. The first line name the columns: id for the entity ID,
+// params.name for a parameter, attr.metadata.name:Type for a metadata of attr and name:Type for a static attribute,
+// Text when the type is omitted. Number values are decoded as numbers and empty cells are ignored.
+func ParseDevicesCSV(in io.Reader) (map[string]*Device, error) {
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header: %s", err)
+	}
+	idCol := -1
+	for i, col := range header {
+		if col == "id" {
+			idCol = i
+		}
+	}
+	if idCol < 0 {
+		return nil, fmt.Errorf("no id column")
+	}
+	devices := map[string]*Device{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id := record[idCol]
+		if _, ok := devices[id]; ok || id == "" {
+			return nil, fmt.Errorf("line %d: missing or duplicate id %q", line, id)
+		}
+		dev := &Device{}
+		for i, col := range header {
+			if i == idCol || record[i] == "" {
+				continue
+			}
+			if err := dev.setColumn(col, record[i]); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+		}
+		devices[id] = dev
+	}
+	if err := checkDevices(devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// setColumn set the value of a CSV registry column.
+func (d *Device) setColumn(col, value string) error {
+	name, typ := col, "Text"
+	if i := strings.LastIndexByte(col, ':'); i >= 0 {
+		name, typ = col[:i], col[i+1:]
+	}
+	if strings.HasPrefix(name, "params.") {
+		if d.Params == nil {
+			d.Params = map[string]interface{}{}
+		}
+		d.Params[strings.TrimPrefix(name, "params.")] = csvValue(value, "")
+		return nil
+	}
+	pair := ngsi.AttrPair{Value: csvValue(value, typ), Type: typ}
+	if split := strings.SplitN(name, ".metadata.", 2); len(split) == 2 {
+		if d.Metadata == nil {
+			d.Metadata = map[string]map[string]ngsi.AttrPair{}
+		}
+		if d.Metadata[split[0]] == nil {
+			d.Metadata[split[0]] = map[string]ngsi.AttrPair{}
+		}
+		d.Metadata[split[0]][split[1]] = pair
+		return nil
+	}
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("invalid column %s", col)
+	}
+	if d.Attrs == nil {
+		d.Attrs = map[string]ngsi.AttrPair{}
+	}
+	d.Attrs[name] = pair
+	return nil
+}
+
+// csvValue decode the cells of the Number columns, and of the parameters when typ is empty, as numbers.
+func csvValue(value, typ string) interface{} {
+	if typ == "Number" || typ == "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return value
+}
+
+// jsonValue convert the objects decoded from YAML to JSON objects.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return v
+}
+
+// checkDevices check the names and types of the static attributes and metadata.
+func checkDevices(devices map[string]*Device) error {
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var msgs []string
+	for _, id := range ids {
+		dev := devices[id]
+		for _, name := range sortedKeys(dev.Attrs) {
+			switch {
+			case name == "id" || name == "type" || name == "timestamp":
+				msgs = append(msgs, fmt.Sprintf("device %s: attribute %s is set by the bridge", id, name))
+			case strings.ContainsAny(name, forbiddenChars):
+				msgs = append(msgs, fmt.Sprintf("device %s: attribute name %q contains a forbidden character", id, name))
+			case dev.Attrs[name].Type == "":
+				msgs = append(msgs, fmt.Sprintf("device %s: attribute %s has no type", id, name))
+			}
+		}
+		for _, attr := range sortedKeys(dev.Metadata) {
+			for _, name := range sortedKeys(dev.Metadata[attr]) {
+				if dev.Metadata[attr][name].Type == "" {
+					msgs = append(msgs, fmt.Sprintf("device %s: metadata %s of %s has no type", id, name, attr))
+				}
+			}
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// apply add the static attributes and metadata of the device to the attributes of its entity.
+func (d *Device) apply(attrs map[string]ngsi.Attribute) {
+	for name, pair := range d.Attrs {
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = ngsi.Attribute{AttrPair: pair}
+		}
+	}
+	for name, metadata := range d.Metadata {
+		attr, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		merged := make(map[string]ngsi.AttrPair, len(attr.Metadata)+len(metadata))
+		for k, v := range attr.Metadata {
+			merged[k] = v
+		}
+		for k, v := range metadata {
+			merged[k] = v
+		}
+		attr.Metadata = merged
+		attrs[name] = attr
+	}
+}
@@ -0,0 +1,83 @@
+package bridges
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestParseDevicesCSV(t *testing.T) {
+	a := assertions.New(t)
+	devices, err := ParseDevicesCSV(strings.NewReader(`id,owner,refBuilding:Relationship,params.capacity,level.metadata.accuracy:Number
+tank-1,Waternet,building-3,40000,0.5
+tank-2,,,20000,
+`))
+	a.So(err, assertions.ShouldBeNil)
+	a.So(devices["tank-1"], assertions.ShouldResemble, &Device{
+		Attrs: map[string]ngsi.AttrPair{
+			"owner":       {Value: "Waternet", Type: "Text"},
+			"refBuilding": {Value: "building-3", Type: "Relationship"},
+		},
+		Metadata: map[string]map[string]ngsi.AttrPair{"level": {"accuracy": {Value: 0.5, Type: "Number"}}},
+		Params:   map[string]interface{}{"capacity": 40000.0},
+	})
+	a.So(devices["tank-2"], assertions.ShouldResemble, &Device{Params: map[string]interface{}{"capacity": 20000.0}})
+
+	_, err = ParseDevicesCSV(strings.NewReader("owner\nWaternet\n"))
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = ParseDevicesCSV(strings.NewReader("id,timestamp\ntank-1,now\n"))
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = ParseDevicesCSV(strings.NewReader("id\ntank-1\ntank-1\n"))
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestRegistry(t *testing.T) {
+	a := assertions.New(t)
+	dir, err := ioutil.TempDir("", "registry")
+	a.So(err, assertions.ShouldBeNil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "devices.yml")
+	a.So(ioutil.WriteFile(file, []byte(`tank-1:
+  attrs:
+    location: {type: geo:json, value: {type: Point, coordinates: [4.89, 52.37]}}
+    level: {type: liters, value: 0}
+  metadata:
+    level:
+      accuracy: {type: Number, value: 0.5}
+  params:
+    capacity: 400
+`), 0644), assertions.ShouldBeNil)
+	reg, err := LoadRegistry(file)
+	a.So(err, assertions.ShouldBeNil)
+
+	sch := NewMapper(map[string]*Schema{"tank": {
+		Attrs:   map[string]string{"level": "liters", "fill": "percentage"},
+		Compute: map[string]string{"fill": "100 * level / params.capacity"},
+		Params:  map[string]interface{}{"capacity": 200},
+	}}).All()["tank"]
+	ents, err := decode(log.Get(), map[string]interface{}{"id": "tank-1", "level": 100.0}, sch, reg)
+	a.So(err, assertions.ShouldBeNil)
+	attrs := ents[0].Attributes
+	a.So(attrs["level"].Value, assertions.ShouldEqual, 100.0)
+	a.So(attrs["level"].Metadata["accuracy"].Value, assertions.ShouldEqual, 0.5)
+	a.So(attrs["fill"].Value, assertions.ShouldEqual, 25.0)
+	a.So(attrs["location"].Value, assertions.ShouldResemble, map[string]interface{}{
+		"type": "Point", "coordinates": []interface{}{4.89, 52.37},
+	})
+	ents, err = decode(log.Get(), map[string]interface{}{"id": "tank-2", "level": 100.0}, sch, reg)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ents[0].Attributes["fill"].Value, assertions.ShouldEqual, 50.0)
+
+	a.So(ioutil.WriteFile(file, []byte("tank-1:\n  owner: me\n"), 0644), assertions.ShouldBeNil)
+	a.So(reg.Reload(), assertions.ShouldNotBeNil)
+	_, ok := reg.Get("tank-1")
+	a.So(ok, assertions.ShouldBeTrue)
+	a.So(reg.changed(), assertions.ShouldBeFalse)
+}
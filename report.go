@@ -0,0 +1,223 @@
+package bridges
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// reportMetrics count the work of the change caches: entities dropped because nothing changed, attributes left out
+// because they didn't change and heartbeats forcing a full update.
+var reportMetrics = expvar.NewMap("report_by_exception")
+
+// SchemaReport enable report by exception: only the attributes that changed since they were last pushed are sent.
+// Numbers change when they move by more than the Deadband of their attribute, other values when they are different.
+// Heartbeat is the longest time without pushing the whole entity, like 15m, empty for none.
+type SchemaReport struct {
+	Deadband  map[string]float64 `json:"deadband,omitempty" yaml:",omitempty"`
+	Heartbeat string             `json:"heartbeat,omitempty" yaml:",omitempty"`
+}
+
+func (r *SchemaReport) heartbeat() time.Duration {
+	d, _ := time.ParseDuration(r.Heartbeat)
+	return d
+}
+
+// check return the problems of the report settings.
+func (r *SchemaReport) check(attrs map[string]string) []pathDiagnostic {
+	var diags []pathDiagnostic
+	if r.Heartbeat != "" {
+		if d, err := time.ParseDuration(r.Heartbeat); err != nil || d <= 0 {
+			diags = append(diags, errorAt(fmt.Sprintf("invalid heartbeat %q", r.Heartbeat), "report", "heartbeat"))
+		}
+	}
+	for _, name := range sortedKeys(r.Deadband) {
+		if r.Deadband[name] < 0 {
+			diags = append(diags, errorAt(fmt.Sprintf("negative deadband for %s", name), "report", "deadband", name))
+		}
+		if _, ok := attrs[name]; !ok {
+			diags = append(diags, errorAt(fmt.Sprintf("deadband for unknown attribute %s", name), "report", "deadband", name))
+		}
+	}
+	return diags
+}
+
+// ChangeCache remember the last values pushed for every entity. It can be persisted to a file so a restart doesn't
+// push everything again.
+type ChangeCache struct {
+	mu       sync.Mutex
+	entities map[string]*lastValues
+	file     string
+}
+
+type lastValues struct {
+	Values map[string]interface{} `json:"values"`
+	Full   time.Time              `json:"full"`
+}
+
+// NewChangeCache return an empty cache kept in memory.
+func NewChangeCache() *ChangeCache {
+	return &ChangeCache{entities: map[string]*lastValues{}}
+}
+
+// LoadChangeCache return a cache persisted to file, read it if it exists. The cache is kept in memory when file is
+// empty.
+func LoadChangeCache(file string) (*ChangeCache, error) {
+	if file == "" {
+		return NewChangeCache(), nil
+	}
+	c := &ChangeCache{entities: map[string]*lastValues{}, file: file}
+	buff, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buff, &c.entities); err != nil {
+		return nil, fmt.Errorf("invalid change cache %s: %s", file, err)
+	}
+	return c, nil
+}
+
+// Save write the cache to its file, if it has one.
+func (c *ChangeCache) Save() error {
+	if c.file == "" {
+		return nil
+	}
+	c.mu.Lock()
+	buff, err := json.Marshal(c.entities)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.file), filepath.Base(c.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buff); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file)
+}
+
+// Persist save the cache every interval. It return a function stopping it and saving a last time.
+func (c *ChangeCache) Persist(ctx log.Interface, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := c.Save(); err != nil {
+					ctx.WithError(err).Warn("Could not save change cache.")
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		if err := c.Save(); err != nil {
+			ctx.WithError(err).Warn("Could not save change cache.")
+		}
+	}
+}
+
+// Filter return the entities with only the attributes that changed, and the timestamp. Entities without change are
+// left out unless their heartbeat is due. The values are remembered as pushed, call Forget if the push fail.
+func (c *ChangeCache) Filter(report *SchemaReport, ents []*ngsi.Entity) []*ngsi.Entity {
+	if c == nil || report == nil {
+		return ents
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at := now()
+	out := make([]*ngsi.Entity, 0, len(ents))
+	for _, ent := range ents {
+		last, ok := c.entities[ent.Id]
+		if !ok || report.Heartbeat != "" && at.Sub(last.Full) >= report.heartbeat() {
+			if ok {
+				reportMetrics.Add("heartbeats", 1)
+			}
+			c.entities[ent.Id] = remember(ent, at)
+			out = append(out, ent)
+			continue
+		}
+		changed := make(map[string]ngsi.Attribute)
+		for name, attr := range ent.Attributes {
+			if name == "timestamp" {
+				continue
+			}
+			old, ok := last.Values[name]
+			if !ok || differ(old, attr.Value, report.Deadband[name]) {
+				changed[name] = attr
+				last.Values[name] = attr.Value
+			} else {
+				reportMetrics.Add("filtered_attrs", 1)
+			}
+		}
+		if len(changed) == 0 {
+			reportMetrics.Add("dropped", 1)
+			continue
+		}
+		if ts, ok := ent.Attributes["timestamp"]; ok {
+			changed["timestamp"] = ts
+		}
+		out = append(out, &ngsi.Entity{Id: ent.Id, Type: ent.Type, Attributes: changed})
+	}
+	return out
+}
+
+// Forget remove the entities from the cache, their next message will be pushed whole.
+func (c *ChangeCache) Forget(ents []*ngsi.Entity) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ent := range ents {
+		delete(c.entities, ent.Id)
+	}
+}
+
+func remember(ent *ngsi.Entity, at time.Time) *lastValues {
+	values := make(map[string]interface{}, len(ent.Attributes))
+	for name, attr := range ent.Attributes {
+		if name != "timestamp" {
+			values[name] = attr.Value
+		}
+	}
+	return &lastValues{Values: values, Full: at}
+}
+
+// differ tell if a value changed. Numbers, or numeric strings, change when they move by more than deadband.
+func differ(old, cur interface{}, deadband float64) bool {
+	o, oerr := number(old)
+	c, cerr := number(cur)
+	if oerr == nil && cerr == nil {
+		d := c - o
+		if d < 0 {
+			d = -d
+		}
+		return d > deadband
+	}
+	return !reflect.DeepEqual(old, cur)
+}
@@ -0,0 +1,60 @@
+package bridges
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestChangeCache(t *testing.T) {
+	a := assertions.New(t)
+	at := time.Date(2019, 1, 16, 16, 0, 0, 0, time.UTC)
+	now = func() time.Time { return at }
+	defer func() { now = time.Now }()
+
+	tank := func(level, temp interface{}) []*ngsi.Entity {
+		return []*ngsi.Entity{{Id: "tank", Type: "WaterTank", Attributes: map[string]ngsi.Attribute{
+			"level":     {AttrPair: ngsi.AttrPair{Value: level, Type: "liters"}},
+			"temp":      {AttrPair: ngsi.AttrPair{Value: temp, Type: "celsius"}},
+			"timestamp": {AttrPair: ngsi.AttrPair{Value: at, Type: "time"}},
+		}}}
+	}
+	report := &SchemaReport{Deadband: map[string]float64{"level": 5}, Heartbeat: "15m"}
+	c := NewChangeCache()
+	a.So(c.Filter(nil, tank(100.0, "6.00")), assertions.ShouldHaveLength, 1)
+	a.So(c.Filter(report, tank(100.0, "6.00"))[0].Attributes, assertions.ShouldHaveLength, 3)
+	a.So(c.Filter(report, tank(104.0, "6.0")), assertions.ShouldBeEmpty)
+
+	out := c.Filter(report, tank(106.0, "6.00"))
+	a.So(out, assertions.ShouldHaveLength, 1)
+	a.So(out[0].Attributes, assertions.ShouldHaveLength, 2)
+	a.So(out[0].Attributes["level"].Value, assertions.ShouldEqual, 106.0)
+	a.So(c.Filter(report, tank(102.0, "6.00")), assertions.ShouldBeEmpty)
+	a.So(c.Filter(report, tank(106.0, "6.5"))[0].Attributes, assertions.ShouldContainKey, "temp")
+
+	at = at.Add(15 * time.Minute)
+	a.So(c.Filter(report, tank(106.0, "6.5"))[0].Attributes, assertions.ShouldHaveLength, 3)
+	c.Forget(tank(0, 0))
+	a.So(c.Filter(report, tank(106.0, "6.5"))[0].Attributes, assertions.ShouldHaveLength, 3)
+
+	dir, err := ioutil.TempDir("", "changes")
+	a.So(err, assertions.ShouldBeNil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "changes.json")
+	c, err = LoadChangeCache(file)
+	a.So(err, assertions.ShouldBeNil)
+	c.Filter(report, tank(100.0, "6.00"))
+	a.So(c.Save(), assertions.ShouldBeNil)
+	c, err = LoadChangeCache(file)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(c.Filter(report, tank(100.0, "6.00")), assertions.ShouldBeEmpty)
+
+	a.So((&SchemaReport{Heartbeat: "often"}).check(nil), assertions.ShouldHaveLength, 1)
+	a.So((&SchemaReport{Deadband: map[string]float64{"level": -1}}).check(map[string]string{"level": "liters"}), assertions.ShouldHaveLength, 1)
+}
@@ -0,0 +1,343 @@
+package bridges
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Destination kinds.
+const (
+	DestNGSI    = "ngsi"
+	DestNGSILD  = "ngsi-ld"
+	DestWebhook = "webhook"
+)
+
+// DefaultDestination name the broker of the bridge in the routes.
+const DefaultDestination = "default"
+
+const (
+	defaultDestQueue            = 100
+	defaultDestBreakerThreshold = 5
+	defaultDestBreakerCooldown  = 30 * time.Second
+)
+
+// routeMetrics count the messages sent, failed and dropped by destination.
+var routeMetrics = expvar.NewMap("routes")
+
+// Destination is where entities are sent besides the broker of the bridge: a NGSI v2 broker (default), a NGSI-LD
+// broker or an HTTP webhook receiving the entities as a JSON array. Token is sent in AuthHeader, X-Auth-Token by
+// default. Service and ServicePath are the tenant headers, NGSILD-Tenant for a NGSI-LD broker. Context is the
+// JSON-LD @context of a NGSI-LD broker, the core one by default. Queue is the number of messages waiting when the
+// destination is slow, the newer ones are dropped.
+type Destination struct {
+	Kind        string            `json:"kind,omitempty" yaml:",omitempty"`
+	URL         string            `json:"url" yaml:"url"`
+	Token       string            `json:"token,omitempty" yaml:",omitempty"`
+	AuthHeader  string            `json:"authHeader,omitempty" yaml:"authHeader,omitempty"`
+	Service     string            `json:"service,omitempty" yaml:",omitempty"`
+	ServicePath string            `json:"servicePath,omitempty" yaml:"servicePath,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:",omitempty"`
+	Context     string            `json:"context,omitempty" yaml:",omitempty"`
+	Queue       int               `json:"queue,omitempty" yaml:",omitempty"`
+	Filter      *DestFilter       `json:"filter,omitempty" yaml:",omitempty"`
+}
+
+// DestFilter select the entities sent to a destination: their Types, their IDs matching one of the IDs patterns, like
+// tank-*, and only the Attrs attributes. Empty lists select everything.
+type DestFilter struct {
+	Types []string `json:"types,omitempty" yaml:",omitempty"`
+	IDs   []string `json:"ids,omitempty" yaml:",omitempty"`
+	Attrs []string `json:"attrs,omitempty" yaml:",omitempty"`
+}
+
+// RoutesConfig name the destinations and list the destinations of each schema key. The schema keys without routes use
+// the default routes, or only the broker of the bridge when there is no default route.
+type RoutesConfig struct {
+	Destinations map[string]*Destination `json:"destinations" yaml:"destinations"`
+	Routes       map[string][]string     `json:"routes" yaml:"routes"`
+}
+
+// ParseRoutes decode a routes file strictly and check it.
+func ParseRoutes(buff []byte) (*RoutesConfig, error) {
+	conf := &RoutesConfig{}
+	if err := yaml.UnmarshalStrict(buff, conf); err != nil {
+		return nil, err
+	}
+	var msgs []string
+	for _, name := range sortedKeys(conf.Destinations) {
+		d := conf.Destinations[name]
+		switch {
+		case name == DefaultDestination:
+			msgs = append(msgs, fmt.Sprintf("destination %s is the broker of the bridge", name))
+		case d == nil || d.URL == "":
+			msgs = append(msgs, fmt.Sprintf("destination %s has no url", name))
+		case d.Kind != "" && d.Kind != DestNGSI && d.Kind != DestNGSILD && d.Kind != DestWebhook:
+			msgs = append(msgs, fmt.Sprintf("destination %s: unknown kind %s", name, d.Kind))
+		}
+		if d != nil && d.Filter != nil {
+			for _, pattern := range d.Filter.IDs {
+				if _, err := path.Match(pattern, ""); err != nil {
+					msgs = append(msgs, fmt.Sprintf("destination %s: invalid id pattern %q", name, pattern))
+				}
+			}
+		}
+	}
+	for _, key := range sortedKeys(conf.Routes) {
+		for _, name := range conf.Routes[key] {
+			if _, ok := conf.Destinations[name]; !ok && name != DefaultDestination {
+				msgs = append(msgs, fmt.Sprintf("route %s: unknown destination %s", key, name))
+			}
+		}
+	}
+	if len(msgs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return conf, nil
+}
+
+// Router send the entities of each schema to its destinations. Every destination has its own queue, worker and
+// circuit breaker so a failing or slow destination doesn't delay the others.
+type Router struct {
+	ctx    log.Interface
+	routes map[string][]string
+	dests  map[string]*destination
+	mu     sync.RWMutex
+	closed bool
+}
+
+type destination struct {
+	name   string
+	conf   *Destination
+	client *ngsi.Client
+	queue  chan []*ngsi.Entity
+	done   chan struct{}
+}
+
+// LoadRouter read a routes file and start the workers of its destinations.
+func LoadRouter(ctx log.Interface, file string) (*Router, error) {
+	buff, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := ParseRoutes(buff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %s", file, err)
+	}
+	return NewRouter(ctx, conf), nil
+}
+
+// NewRouter start the workers of the destinations.
+func NewRouter(ctx log.Interface, conf *RoutesConfig) *Router {
+	r := &Router{ctx: ctx, routes: conf.Routes, dests: map[string]*destination{}}
+	for name, conf := range conf.Destinations {
+		d := &destination{name: name, conf: conf, client: conf.client(name), done: make(chan struct{})}
+		size := conf.Queue
+		if size <= 0 {
+			size = defaultDestQueue
+		}
+		d.queue = make(chan []*ngsi.Entity, size)
+		r.dests[name] = d
+		go d.work(ctx.WithField("destination", name))
+	}
+	return r
+}
+
+// client return the broker client of the destination, with its credentials and tenant headers.
+func (d *Destination) client(name string) *ngsi.Client {
+	c := ngsi.NewClient(strings.TrimSuffix(d.URL, "/"))
+	c.Breaker = ngsi.NewBreaker(name, defaultDestBreakerThreshold, defaultDestBreakerCooldown)
+	if d.Token != "" {
+		c.Tokens = ngsi.StaticToken(d.Token)
+		c.AuthHeader = d.AuthHeader
+	}
+	c.Headers = http.Header{}
+	for k, v := range d.Headers {
+		c.Headers.Set(k, v)
+	}
+	switch d.Kind {
+	case DestNGSILD:
+		if d.Service != "" {
+			c.Headers.Set("NGSILD-Tenant", d.Service)
+		}
+		if d.Context != "" {
+			c.Headers.Set("Link", ngsi.LDContextLink(d.Context))
+		}
+	default:
+		if d.Service != "" {
+			c.Headers.Set("Fiware-Service", d.Service)
+		}
+		if d.ServicePath != "" {
+			c.Headers.Set("Fiware-ServicePath", d.ServicePath)
+		}
+	}
+	return c
+}
+
+// destinations return the names of the destinations of the schema key.
+func (r *Router) destinations(key string) []string {
+	if names, ok := r.routes[key]; ok {
+		return names
+	}
+	if names, ok := r.routes[DefaultDestination]; ok {
+		return names
+	}
+	return []string{DefaultDestination}
+}
+
+// Primary tell if the entities of the schema key go to the broker of the bridge. Without router they always do.
+func (r *Router) Primary(key string) bool {
+	if r == nil {
+		return true
+	}
+	for _, name := range r.destinations(key) {
+		if name == DefaultDestination {
+			return true
+		}
+	}
+	return false
+}
+
+// Send queue the entities of the schema key to its destinations other than the broker of the bridge. The entities
+// are dropped for the destinations whose queue is full, and once the router is closed.
+func (r *Router) Send(key string, ents []*ngsi.Entity) {
+	if r == nil {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		r.ctx.Warn("Router is closed, dropped entities.")
+		return
+	}
+	for _, name := range r.destinations(key) {
+		d, ok := r.dests[name]
+		if !ok {
+			continue
+		}
+		selected := d.conf.Filter.apply(ents)
+		if len(selected) == 0 {
+			continue
+		}
+		select {
+		case d.queue <- selected:
+		default:
+			routeMetrics.Add(name+"_dropped", 1)
+			r.ctx.WithField("destination", name).Warn("Destination queue is full, dropped entities.")
+		}
+	}
+}
+
+// Close stop the workers once they sent the queued entities.
+func (r *Router) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	r.mu.Unlock()
+	names := make([]string, 0, len(r.dests))
+	for name := range r.dests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		close(r.dests[name].queue)
+	}
+	for _, name := range names {
+		<-r.dests[name].done
+	}
+}
+
+func (d *destination) work(ctx log.Interface) {
+	defer close(d.done)
+	for ents := range d.queue {
+		if err := d.send(ctx, ents); err != nil {
+			routeMetrics.Add(d.name+"_failed", 1)
+			ctx.WithError(err).Warn("Could not send entities to destination.")
+			continue
+		}
+		routeMetrics.Add(d.name+"_sent", 1)
+	}
+}
+
+func (d *destination) send(ctx log.Interface, ents []*ngsi.Entity) error {
+	switch d.conf.Kind {
+	case DestNGSILD:
+		return d.client.UpsertLD(ctx, ents)
+	case DestWebhook:
+		_, err := d.client.Send(ctx, "POST", "", ents)
+		return err
+	}
+	if len(ents) == 1 {
+		return d.client.PushAttributes(ctx, ents[0])
+	}
+	return d.client.PushEntities(ctx, ents)
+}
+
+// apply return the entities selected by the filter, with only the selected attributes and their timestamp.
+func (f *DestFilter) apply(ents []*ngsi.Entity) []*ngsi.Entity {
+	if f == nil {
+		return ents
+	}
+	out := make([]*ngsi.Entity, 0, len(ents))
+	for _, ent := range ents {
+		if !f.selects(ent) {
+			continue
+		}
+		if len(f.Attrs) == 0 {
+			out = append(out, ent)
+			continue
+		}
+		attrs := map[string]ngsi.Attribute{}
+		for _, name := range f.Attrs {
+			if attr, ok := ent.Attributes[name]; ok {
+				attrs[name] = attr
+			}
+		}
+		if len(attrs) == 0 {
+			continue
+		}
+		if ts, ok := ent.Attributes["timestamp"]; ok {
+			attrs["timestamp"] = ts
+		}
+		out = append(out, &ngsi.Entity{Id: ent.Id, Type: ent.Type, Attributes: attrs})
+	}
+	return out
+}
+
+func (f *DestFilter) selects(ent *ngsi.Entity) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			found = found || t == ent.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.IDs) == 0 {
+		return true
+	}
+	for _, pattern := range f.IDs {
+		if ok, _ := path.Match(pattern, ent.Id); ok {
+			return true
+		}
+	}
+	return false
+}
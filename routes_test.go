@@ -0,0 +1,102 @@
+package bridges
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestParseRoutes(t *testing.T) {
+	a := assertions.New(t)
+	_, err := ParseRoutes([]byte(`
+destinations:
+  default:
+    url: http://orion:1026
+  partner:
+    kind: mqtt
+    url: tcp://partner
+  staging: {}
+routes:
+  ttn: [default, prod]
+`))
+	a.So(err, assertions.ShouldBeError, "destination default is the broker of the bridge; destination partner: unknown kind mqtt; "+
+		"destination staging has no url; route ttn: unknown destination prod")
+	_, err = ParseRoutes([]byte("destinations: {}\nroute: {}\n"))
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestRouter(t *testing.T) {
+	a := assertions.New(t)
+	var mu sync.Mutex
+	received := map[string][]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		buff, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(buff, &body)
+		mu.Lock()
+		received[r.Header.Get("Fiware-Service")+r.URL.Path] = append(received[r.Header.Get("Fiware-Service")+r.URL.Path], body)
+		mu.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	conf, err := ParseRoutes([]byte(`
+destinations:
+  staging:
+    url: ` + srv.URL + `
+    service: waternet
+  partner:
+    kind: webhook
+    url: ` + srv.URL + `/hook
+    filter:
+      ids: ["tank-*"]
+      attrs: [level]
+  broken:
+    kind: webhook
+    url: ` + srv.URL + `/broken
+routes:
+  default: [default, staging]
+  ttn: [staging, partner, broken]
+`))
+	a.So(err, assertions.ShouldBeNil)
+	r := NewRouter(log.Get(), conf)
+	a.So(r.Primary("particle"), assertions.ShouldBeTrue)
+	a.So(r.Primary("ttn"), assertions.ShouldBeFalse)
+	var noRouter *Router
+	a.So(noRouter.Primary("ttn"), assertions.ShouldBeTrue)
+
+	tank := func(id string) []*ngsi.Entity {
+		return []*ngsi.Entity{{Id: id, Type: "WaterTank", Attributes: map[string]ngsi.Attribute{
+			"level": {AttrPair: ngsi.AttrPair{Value: 120.0, Type: "liters"}},
+			"temp":  {AttrPair: ngsi.AttrPair{Value: 6.0, Type: "celsius"}},
+		}}}
+	}
+	r.Send("ttn", tank("tank-1"))
+	r.Send("ttn", tank("pump-1"))
+	r.Send("particle", tank("tank-2"))
+	r.Close()
+	// Entities sent once the router is closed are dropped.
+	r.Send("ttn", tank("tank-3"))
+	r.Close()
+
+	a.So(received["waternet/v2/entities/tank-1/attrs"], assertions.ShouldHaveLength, 1)
+	a.So(received["waternet/v2/entities/pump-1/attrs"], assertions.ShouldHaveLength, 1)
+	a.So(received["waternet/v2/entities/tank-2/attrs"], assertions.ShouldHaveLength, 1)
+	a.So(received["/hook"], assertions.ShouldResemble, []interface{}{[]interface{}{
+		map[string]interface{}{"id": "tank-1", "type": "WaterTank", "level": map[string]interface{}{"value": 120.0, "type": "liters"}},
+	}})
+	a.So(received["/broken"], assertions.ShouldHaveLength, 2)
+	a.So(received["waternet/v2/entities/tank-3/attrs"], assertions.ShouldBeEmpty)
+}
@@ -0,0 +1,464 @@
+package bridges
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultSchema is the key of the schema used for the messages whose key has no schema.
+const DefaultSchema = "default"
+
+// Schema describe how a message is converted to a NGSI entity. A schema can extend another one: it inherits its
+// fields and override them, Attrs, Replace, Compute and Params entries are merged and an entry set to ~ remove the
+// inherited one.
+//
+// Compute give the expression of the computed attributes, their type is given by Attrs. Expressions use the fields
+// of the message and the static parameters: Params, overridden by the Devices entry of the entity ID.
+type Schema struct {
+	Extends string                            `json:"extends,omitempty" yaml:",omitempty"`
+	Type    string                            `json:"type,omitempty" yaml:",omitempty"`
+	Attrs   map[string]string                 `json:"attrs,omitempty" yaml:",omitempty"`
+	Replace map[string]string                 `json:"replace,omitempty" yaml:",omitempty"`
+	Compute map[string]string                 `json:"compute,omitempty" yaml:",omitempty"`
+	Params  map[string]interface{}            `json:"params,omitempty" yaml:",omitempty"`
+	Devices map[string]map[string]interface{} `json:"devices,omitempty" yaml:",omitempty"`
+	ID      string                            `json:"id,omitempty" yaml:",omitempty"`
+	Data    SchemaData                        `json:"data,omitempty" yaml:",omitempty"`
+	Split   *SchemaSplit                      `json:"split,omitempty" yaml:",omitempty"`
+	Report  *SchemaReport                     `json:"report,omitempty" yaml:",omitempty"`
+	Dedup   *SchemaDedup                      `json:"dedup,omitempty" yaml:",omitempty"`
+	Limit   *SchemaLimit                      `json:"limit,omitempty" yaml:",omitempty"`
+
+	// exprs are the compiled Compute expressions and selectors the parsed Attrs and Replace selectors, set by
+	// resolve.
+	exprs     map[string]expr
+	selectors map[string]*selector
+}
+
+// SchemaData locate the readings inside a message, Field is a dotted path and Format how its content is encoded: json
+// (default), csv, form, cbor, lpp (Cayenne LPP) or binary, optionally preceded by base64 or hex like base64+cbor.
+// Columns name the values of a CSV line, separated by Delimiter. Layout describe the values of a binary payload.
+type SchemaData struct {
+	Field     string        `json:"field,omitempty" yaml:",omitempty"`
+	Format    string        `json:"format,omitempty" yaml:",omitempty"`
+	Columns   []string      `json:"columns,omitempty" yaml:",omitempty"`
+	Delimiter string        `json:"delimiter,omitempty" yaml:",omitempty"`
+	Layout    []BinaryField `json:"layout,omitempty" yaml:",omitempty"`
+}
+
+// SchemaSplit make a message produce an entity per child sensor besides the entity of the message. Children are the
+// objects of the array selected by Field, or the fields starting with one of the Prefixes, named without the prefix
+// and a following _. Children are converted with the replace and attrs of the schema.
+//
+// ID is the template of the children ID, {id} is replaced by the message entity ID, {index} by the position of the
+// child in the array, {prefix} by its prefix and other names by the child fields. Children link back to the message
+// entity with the Ref relationship attribute, refDevice by default. Their type is Type, or the type of the schema.
+type SchemaSplit struct {
+	Field    string   `json:"field,omitempty" yaml:",omitempty"`
+	Prefixes []string `json:"prefixes,omitempty" yaml:",omitempty"`
+	ID       string   `json:"id,omitempty" yaml:",omitempty"`
+	Type     string   `json:"type,omitempty" yaml:",omitempty"`
+	Ref      string   `json:"ref,omitempty" yaml:",omitempty"`
+}
+
+// Validate check the schema can be used to decode messages. A schema extending another one can only be validated
+// with the schemas it extends, see Mapper.Check.
+func (s *Schema) Validate() error {
+	var diags Diagnostics
+	for _, d := range s.check() {
+		diags = append(diags, d.Diagnostic)
+	}
+	return diags.Err()
+}
+
+// merge return the schema s extending parent.
+func (s *Schema) merge(parent *Schema) *Schema {
+	m := *parent
+	m.Extends = s.Extends
+	m.Attrs = mergeMap(parent.Attrs, s.Attrs)
+	m.Replace = mergeMap(parent.Replace, s.Replace)
+	m.Compute = mergeMap(parent.Compute, s.Compute)
+	m.Params = mergeParams(parent.Params, s.Params)
+	if s.Devices != nil {
+		m.Devices = make(map[string]map[string]interface{}, len(parent.Devices)+len(s.Devices))
+		for id, params := range parent.Devices {
+			m.Devices[id] = params
+		}
+		for id, params := range s.Devices {
+			m.Devices[id] = mergeParams(parent.Devices[id], params)
+		}
+	}
+	if s.Type != "" {
+		m.Type = s.Type
+	}
+	if s.ID != "" {
+		m.ID = s.ID
+	}
+	if s.Data.Field != "" {
+		m.Data.Field = s.Data.Field
+	}
+	if s.Data.Format != "" {
+		m.Data.Format = s.Data.Format
+	}
+	if s.Data.Columns != nil {
+		m.Data.Columns = s.Data.Columns
+	}
+	if s.Data.Delimiter != "" {
+		m.Data.Delimiter = s.Data.Delimiter
+	}
+	if s.Data.Layout != nil {
+		m.Data.Layout = s.Data.Layout
+	}
+	if s.Split != nil {
+		m.Split = s.Split
+	}
+	if s.Report != nil {
+		m.Report = s.Report
+	}
+	if s.Dedup != nil {
+		m.Dedup = s.Dedup
+	}
+	if s.Limit != nil {
+		m.Limit = s.Limit
+	}
+	return &m
+}
+
+func mergeMap(parent, child map[string]string) map[string]string {
+	if len(parent) == 0 && len(child) == 0 {
+		return child
+	}
+	m := make(map[string]string, len(parent)+len(child))
+	for k, v := range parent {
+		m[k] = v
+	}
+	for k, v := range child {
+		if v == "" {
+			delete(m, k)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// mergeParams return the parameters of parent overridden by child, a nil value remove the parameter.
+func mergeParams(parent, child map[string]interface{}) map[string]interface{} {
+	if len(parent) == 0 && len(child) == 0 {
+		return child
+	}
+	m := make(map[string]interface{}, len(parent)+len(child))
+	for k, v := range parent {
+		m[k] = v
+	}
+	for k, v := range child {
+		if v == nil {
+			delete(m, k)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// params return the static parameters of the entity id, the parameters of the device registry overriding the schema
+// ones.
+func (s *Schema) params(id string, dev *Device) map[string]interface{} {
+	params := mergeParams(s.Params, s.Devices[id])
+	if dev != nil {
+		params = mergeParams(params, dev.Params)
+	}
+	return params
+}
+
+// compile return a copy of the schema with its expressions and selectors compiled. Invalid ones are left out, they
+// are reported by check.
+func (s *Schema) compile() *Schema {
+	c := *s
+	c.exprs = make(map[string]expr, len(s.Compute))
+	for name, src := range s.Compute {
+		if e, err := compileExpr(src); err == nil {
+			c.exprs[name] = e
+		}
+	}
+	c.selectors = make(map[string]*selector)
+	for key := range s.Attrs {
+		if sel, err := parseSelector(key); err == nil && isSelector(key) {
+			c.selectors[key] = sel
+		}
+	}
+	for _, from := range s.Replace {
+		if sel, err := parseSelector(from); err == nil && isSelector(from) {
+			c.selectors[from] = sel
+		}
+	}
+	if s.Split != nil && s.Split.Field != "" {
+		if sel, err := parseSelector(s.Split.Field); err == nil {
+			c.selectors[s.Split.Field] = sel
+		}
+	}
+	return &c
+}
+
+// selector return the selector str, nil if it is invalid.
+func (s *Schema) selector(str string) *selector {
+	if sel, ok := s.selectors[str]; ok {
+		return sel
+	}
+	sel, _ := parseSelector(str)
+	return sel
+}
+
+// resolve merge every schema with the schemas it extends. Schemas extending an unknown schema or part of an extends
+// cycle are left out of the result and reported.
+func resolve(schemas map[string]*Schema) (map[string]*Schema, []pathDiagnostic) {
+	resolved := make(map[string]*Schema, len(schemas))
+	var diags []pathDiagnostic
+	var visit func(key string, chain []string) *Schema
+	visit = func(key string, chain []string) *Schema {
+		if r, ok := resolved[key]; ok {
+			return r
+		}
+		sch := schemas[key]
+		if sch == nil {
+			resolved[key] = nil
+			return nil
+		}
+		if sch.Extends == "" {
+			resolved[key] = sch.compile()
+			return resolved[key]
+		}
+		for i, k := range chain {
+			if k == key {
+				d := errorAt(fmt.Sprintf("extends cycle %s -> %s", strings.Join(chain[i:], " -> "), key), "extends")
+				d.Schema = key
+				diags = append(diags, d)
+				return nil
+			}
+		}
+		if _, ok := schemas[sch.Extends]; !ok {
+			d := errorAt(fmt.Sprintf("extends unknown schema %s", sch.Extends), "extends")
+			d.Schema = key
+			diags = append(diags, d)
+			return nil
+		}
+		parent := visit(sch.Extends, append(chain, key))
+		if parent == nil {
+			return nil
+		}
+		resolved[key] = sch.merge(parent).compile()
+		return resolved[key]
+	}
+	for _, key := range sortedKeys(schemas) {
+		visit(key, nil)
+	}
+	return resolved, diags
+}
+
+// Mapper hold the schemas used by the bridges, by key. Schemas are always replaced as a whole so a message is decoded
+// with a consistent set even while they are reloaded or edited.
+type Mapper struct {
+	// Persist write every change made with Set or Delete back to the mapper file.
+	Persist bool
+	// Devices give the static attributes, metadata and parameters merged into the entities, by entity ID.
+	Devices *Registry
+
+	mu       sync.RWMutex
+	schemas  map[string]*Schema
+	resolved map[string]*Schema
+	file     string
+	modTime  time.Time
+}
+
+// NewMapper return a mapper with the given schemas and no backing file.
+func NewMapper(schemas map[string]*Schema) *Mapper {
+	if schemas == nil {
+		schemas = map[string]*Schema{}
+	}
+	resolved, _ := resolve(schemas)
+	return &Mapper{schemas: schemas, resolved: resolved}
+}
+
+// LoadMapper read the schemas from a YAML mapper file.
+func LoadMapper(filename string) (*Mapper, error) {
+	m := &Mapper{file: filename}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadSchemas read the schemas of a YAML mapper file, as written in the file. Unknown fields and invalid schemas are
+// errors, see ParseSchemas.
+func ReadSchemas(filename string) (map[string]*Schema, error) {
+	buff, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	schemas, diags := ParseSchemas(buff)
+	if err = diags.Err(); err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+// Get return the schema for key, merged with the schemas it extends. The default schema is returned for a key
+// without schema.
+func (m *Mapper) Get(key string) (*Schema, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sch, ok := m.resolved[key]
+	if !ok {
+		sch, ok = m.resolved[DefaultSchema]
+	}
+	return sch, ok
+}
+
+// Defined tell if key has its own schema.
+func (m *Mapper) Defined(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.schemas[key]
+	return ok
+}
+
+// All return the current schemas merged with the schemas they extend. The map must not be modified.
+func (m *Mapper) All() map[string]*Schema {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.resolved
+}
+
+// Raw return the current schemas as they are defined. The map must not be modified.
+func (m *Mapper) Raw() map[string]*Schema {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.schemas
+}
+
+// Reload read the mapper file again. The current schemas are kept if the file is invalid, the file won't be
+// considered changed until it is modified again.
+func (m *Mapper) Reload() error {
+	if m.file == "" {
+		return fmt.Errorf("mapper has no file")
+	}
+	info, err := os.Stat(m.file)
+	if err != nil {
+		return err
+	}
+	schemas, err := ReadSchemas(m.file)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.modTime = info.ModTime()
+	if err != nil {
+		return fmt.Errorf("invalid mapper file %s: %s", m.file, err)
+	}
+	m.schemas = schemas
+	m.resolved, _ = resolve(schemas)
+	return nil
+}
+
+// Check tell if the schemas would still be valid with sch set for key, or key removed if sch is nil.
+func (m *Mapper) Check(key string, sch *Schema) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, err := m.change(key, sch)
+	return err
+}
+
+// Set add or replace the schema for key.
+func (m *Mapper) Set(key string, sch *Schema) error {
+	return m.update(key, sch)
+}
+
+// Delete remove the schema for key. A schema extended by another one can't be removed.
+func (m *Mapper) Delete(key string) error {
+	return m.update(key, nil)
+}
+
+// change return a copy of the schemas with sch set for key, or key removed if sch is nil, and check it.
+func (m *Mapper) change(key string, sch *Schema) (map[string]*Schema, error) {
+	schemas := make(map[string]*Schema, len(m.schemas)+1)
+	for k, v := range m.schemas {
+		schemas[k] = v
+	}
+	if sch == nil {
+		delete(schemas, key)
+	} else {
+		schemas[key] = sch
+	}
+	return schemas, checkSchemas(schemas).Err()
+}
+
+// update apply a change to a copy of the schemas and swap it in.
+func (m *Mapper) update(key string, sch *Schema) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schemas, err := m.change(key, sch)
+	if err != nil {
+		return err
+	}
+	if m.Persist && m.file != "" {
+		if err := m.write(schemas); err != nil {
+			return fmt.Errorf("could not persist schemas: %s", err)
+		}
+	}
+	m.schemas = schemas
+	m.resolved, _ = resolve(schemas)
+	return nil
+}
+
+// write replace the mapper file atomically. The caller must hold the lock.
+func (m *Mapper) write(schemas map[string]*Schema) error {
+	buff, err := yaml.Marshal(schemas)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.file), filepath.Base(m.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// The temporary file is created 0600, it keep the mode of the file it replace.
+	if info, err := os.Stat(m.file); err == nil {
+		if err = tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err = tmp.Write(buff); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), m.file); err != nil {
+		return err
+	}
+	if info, err := os.Stat(m.file); err == nil {
+		m.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// changed tell if the mapper file was modified since it was last read or written.
+func (m *Mapper) changed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return modified(m.file, m.modTime)
+}
+
+// Watch reload the mapper file when it is modified, checking every interval, or when the process receive SIGHUP. It
+// return a function stopping the watch.
+func (m *Mapper) Watch(ctx log.Interface, interval time.Duration) func() {
+	return watchFile(ctx.WithField("mapper", m.file), interval, m.changed, m.Reload, "schemas")
+}
@@ -0,0 +1,83 @@
+package bridges
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestMapper(t *testing.T) {
+	a := assertions.New(t)
+	dir, err := ioutil.TempDir("", "mapper")
+	a.So(err, assertions.ShouldBeNil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mapper.yml")
+	a.So(ioutil.WriteFile(file, []byte("tank:\n  attrs:\n    level: meter\n"), 0644), assertions.ShouldBeNil)
+
+	m, err := LoadMapper(file)
+	a.So(err, assertions.ShouldBeNil)
+	sch, ok := m.Get("tank")
+	a.So(ok, assertions.ShouldBeTrue)
+	a.So(sch.Attrs, assertions.ShouldResemble, map[string]string{"level": "meter"})
+
+	a.So(ioutil.WriteFile(file, []byte("tank:\n  attrs: {}\n"), 0644), assertions.ShouldBeNil)
+	a.So(m.Reload(), assertions.ShouldNotBeNil)
+	_, ok = m.Get("tank")
+	a.So(ok, assertions.ShouldBeTrue)
+
+	m.Persist = true
+	a.So(m.Set("valve", &Schema{Attrs: map[string]string{"open": "bool"}}), assertions.ShouldBeNil)
+	a.So(m.Set("broken", &Schema{}), assertions.ShouldNotBeNil)
+	a.So(m.Delete("tank"), assertions.ShouldBeNil)
+	schemas, err := ReadSchemas(file)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(len(schemas), assertions.ShouldEqual, 1)
+	a.So(schemas["valve"].Attrs["open"], assertions.ShouldEqual, "bool")
+	a.So(m.changed(), assertions.ShouldBeFalse)
+	info, err := os.Stat(file)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(info.Mode().Perm(), assertions.ShouldEqual, os.FileMode(0644))
+}
+
+func TestMapperExtends(t *testing.T) {
+	a := assertions.New(t)
+	m := NewMapper(map[string]*Schema{
+		DefaultSchema: {
+			Type:    "WaterTank",
+			Attrs:   map[string]string{"temp": "celsius", "level": "liters"},
+			Replace: map[string]string{"id": "devid"},
+		},
+		"particle": {
+			Extends: DefaultSchema,
+			Attrs:   map[string]string{"level": "meter", "temp": ""},
+			Data:    SchemaData{Field: "data", Format: "json"},
+		},
+		"electron": {
+			Extends: "particle",
+			Type:    "Valve",
+			Replace: map[string]string{"id": "coreid"},
+		},
+	})
+	sch, ok := m.Get("electron")
+	a.So(ok, assertions.ShouldBeTrue)
+	a.So(sch.Type, assertions.ShouldEqual, "Valve")
+	a.So(sch.Attrs, assertions.ShouldResemble, map[string]string{"level": "meter"})
+	a.So(sch.Replace, assertions.ShouldResemble, map[string]string{"id": "coreid"})
+	a.So(sch.Data.Field, assertions.ShouldEqual, "data")
+	a.So(m.Raw()["electron"].Attrs, assertions.ShouldBeNil)
+
+	sch, ok = m.Get("unknown")
+	a.So(ok, assertions.ShouldBeTrue)
+	a.So(sch.Attrs["temp"], assertions.ShouldEqual, "celsius")
+	a.So(m.Defined("unknown"), assertions.ShouldBeFalse)
+
+	a.So(m.Check("particle", nil), assertions.ShouldNotBeNil)
+	a.So(m.Check(DefaultSchema, &Schema{Extends: "electron", Attrs: map[string]string{"a": "b"}}), assertions.ShouldNotBeNil)
+	a.So(m.Set("orphan", &Schema{Extends: "missing"}), assertions.ShouldNotBeNil)
+	a.So(m.Delete("electron"), assertions.ShouldBeNil)
+	_, ok = NewMapper(nil).Get("unknown")
+	a.So(ok, assertions.ShouldBeFalse)
+}
@@ -0,0 +1,141 @@
+package bridges
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// selector is a JSONPath like path selecting values in a message: $.sensors.t[0].v, sensors['t'][-1] or
+// sensors.*[*].v. The leading $ is optional, negative indexes count from the end of the array and * select every
+// element of an object or array. A selector with a wildcard select the array of the values it matches.
+type selector struct {
+	steps    []selectorStep
+	wildcard bool
+}
+
+type selectorStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// isSelector tell if an Attrs key or a Replace value is a selector rather than a top level field name.
+func isSelector(str string) bool {
+	return strings.ContainsAny(str, ".[*") || strings.HasPrefix(str, "$")
+}
+
+// parseSelector read a selector.
+func parseSelector(str string) (*selector, error) {
+	sel := &selector{}
+	rest := strings.TrimPrefix(str, "$")
+	for first := rest == str; rest != ""; first = false {
+		var step selectorStep
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("selector %s: missing ]", str)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.key = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("selector %s: invalid index %s", str, inner)
+				}
+				step.index, step.isIndex = n, true
+			}
+		case rest[0] == '.' || first:
+			if rest[0] == '.' {
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("selector %s: empty field name", str)
+			}
+			step.key, rest = rest[:end], rest[end:]
+			step.wildcard = step.key == "*"
+		default:
+			return nil, fmt.Errorf("selector %s: unexpected %s", str, rest)
+		}
+		sel.wildcard = sel.wildcard || step.wildcard
+		sel.steps = append(sel.steps, step)
+	}
+	if len(sel.steps) == 0 {
+		return nil, fmt.Errorf("selector %s: empty selector", str)
+	}
+	return sel, nil
+}
+
+// name return the attribute name of an Attrs selector: the last field name before the first index or wildcard, so
+// sensors.humidity[*].v name an humidity attribute, or the last field name when there is none.
+func (sel *selector) name() string {
+	name := ""
+	for _, s := range sel.steps {
+		if s.isIndex || s.wildcard {
+			break
+		}
+		name = s.key
+	}
+	return name
+}
+
+// find return the value selected in msg. A selector with a wildcard is found when it match at least one value.
+func (sel *selector) find(msg map[string]interface{}) (interface{}, bool) {
+	matches := sel.walk(msg, sel.steps, nil)
+	if len(matches) == 0 {
+		return nil, false
+	}
+	if sel.wildcard {
+		return matches, true
+	}
+	return matches[0], true
+}
+
+func (sel *selector) walk(v interface{}, steps []selectorStep, matches []interface{}) []interface{} {
+	if len(steps) == 0 {
+		return append(matches, v)
+	}
+	step := steps[0]
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if step.wildcard {
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				matches = sel.walk(v[k], steps[1:], matches)
+			}
+		} else if child, ok := v[step.key]; ok && !step.isIndex {
+			matches = sel.walk(child, steps[1:], matches)
+		}
+	case []interface{}:
+		if step.wildcard {
+			for _, child := range v {
+				matches = sel.walk(child, steps[1:], matches)
+			}
+		} else if step.isIndex {
+			i := step.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				matches = sel.walk(v[i], steps[1:], matches)
+			}
+		}
+	}
+	return matches
+}
@@ -0,0 +1,53 @@
+package bridges
+
+import (
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestSelector(t *testing.T) {
+	msg := map[string]interface{}{
+		"level": 2.0,
+		"sensors": map[string]interface{}{
+			"t": []interface{}{
+				map[string]interface{}{"v": 1.0},
+				map[string]interface{}{"v": 2.0},
+			},
+			"h": []interface{}{
+				map[string]interface{}{"v": 3.0},
+			},
+		},
+	}
+	for _, tt := range []struct {
+		sel, name string
+		out       interface{}
+	}{
+		{"$.level", "level", 2.0},
+		{"sensors.t[0].v", "t", 1.0},
+		{"$.sensors.t[-1]", "t", map[string]interface{}{"v": 2.0}},
+		{"sensors['t'][1].v", "t", 2.0},
+		{"sensors.t[*].v", "t", []interface{}{1.0, 2.0}},
+		{"sensors.*[*].v", "sensors", []interface{}{3.0, 1.0, 2.0}},
+	} {
+		a := assertions.New(t)
+		sel, err := parseSelector(tt.sel)
+		a.So(err, assertions.ShouldBeNil)
+		a.So(sel.name(), assertions.ShouldEqual, tt.name)
+		out, ok := sel.find(msg)
+		a.So(ok, assertions.ShouldBeTrue)
+		a.So(out, assertions.ShouldResemble, tt.out)
+	}
+
+	a := assertions.New(t)
+	for _, str := range []string{"sensors.t[2]", "sensors.x[*]", "level.v", "sensors[0]"} {
+		sel, err := parseSelector(str)
+		a.So(err, assertions.ShouldBeNil)
+		_, ok := sel.find(msg)
+		a.So(ok, assertions.ShouldBeFalse)
+	}
+	for _, str := range []string{"$", "$level", "sensors..t", "sensors[t]", "sensors[0"} {
+		_, err := parseSelector(str)
+		a.So(err, assertions.ShouldNotBeNil)
+	}
+}
@@ -0,0 +1,185 @@
+package bridges
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ngsi-bridge/ngsi"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// defaultRef is the relationship attribute linking the children of a split message to the message entity.
+const defaultRef = "refDevice"
+
+// split return the entities of the children of a message, see SchemaSplit.
+func split(ctx log.Interface, msg map[string]interface{}, sch *Schema, parent *ngsi.Entity, devices *Registry) ([]*ngsi.Entity, error) {
+	type child struct {
+		fields map[string]interface{}
+		vars   map[string]string
+	}
+	var children []child
+	sp := sch.Split
+	if sp.Field != "" {
+		sel := sch.selector(sp.Field)
+		if sel == nil {
+			return nil, fmt.Errorf("invalid split field %s", sp.Field)
+		}
+		v, ok := sel.find(msg)
+		if !ok {
+			return nil, fmt.Errorf("could not find split field %s", sp.Field)
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("split field %s is not an array", sp.Field)
+		}
+		for i, elem := range arr {
+			fields, ok := elem.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("split field %s: child %d is not an object", sp.Field, i)
+			}
+			children = append(children, child{fields, map[string]string{"index": strconv.Itoa(i)}})
+		}
+	}
+	for _, prefix := range sp.Prefixes {
+		fields := make(map[string]interface{})
+		for k, v := range msg {
+			if name := strings.TrimPrefix(k, prefix+"_"); name != k && name != "" {
+				fields[name] = v
+			}
+		}
+		if len(fields) > 0 {
+			children = append(children, child{fields, map[string]string{"prefix": prefix}})
+		}
+	}
+
+	typ := sp.Type
+	if typ == "" {
+		typ = parent.Type
+	}
+	ref := sp.Ref
+	if ref == "" {
+		ref = defaultRef
+	}
+	template := sp.ID
+	if template == "" {
+		template = sp.defaultID()
+	}
+	ents := make([]*ngsi.Entity, 0, len(children))
+	for _, c := range children {
+		c.vars["id"] = parent.Id
+		id, err := expandID(template, c.vars, c.fields)
+		if err != nil {
+			return nil, err
+		}
+		ent, err := entity(ctx, replaceField(c.fields, sch), sch, id, typ, devices)
+		if err != nil {
+			return nil, fmt.Errorf("child %s: %s", id, err)
+		}
+		ent.Attributes[ref] = ngsi.Attribute{
+			AttrPair: ngsi.AttrPair{
+				Type:  "Relationship",
+				Value: parent.Id,
+			},
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// defaultID return the ID template of the children when the schema doesn't set one.
+func (sp *SchemaSplit) defaultID() string {
+	if sp.Field != "" {
+		return "{id}-{index}"
+	}
+	return "{id}-{prefix}"
+}
+
+// check return the problems of the split settings.
+func (sp *SchemaSplit) check(attrs map[string]string) []pathDiagnostic {
+	var diags []pathDiagnostic
+	if (sp.Field == "") == (len(sp.Prefixes) == 0) {
+		diags = append(diags, errorAt("split needs either a field or prefixes", "split"))
+	}
+	if sp.Field != "" {
+		if _, err := parseSelector(sp.Field); err != nil {
+			diags = append(diags, errorAt(err.Error(), "split", "field"))
+		}
+	}
+	for _, prefix := range sp.Prefixes {
+		if prefix == "" {
+			diags = append(diags, errorAt("empty split prefix", "split", "prefixes"))
+		}
+	}
+	if sp.ID != "" {
+		names, err := placeholders(sp.ID)
+		unique := false
+		for _, name := range names {
+			unique = unique || name != "id"
+		}
+		switch {
+		case err != nil:
+			diags = append(diags, errorAt(err.Error(), "split", "id"))
+		case !unique:
+			diags = append(diags, errorAt(fmt.Sprintf("ID template %s give the same ID to every child", sp.ID), "split", "id"))
+		}
+	}
+	ref := sp.Ref
+	if ref == "" {
+		ref = defaultRef
+	}
+	if _, ok := attrs[ref]; ok {
+		diags = append(diags, errorAt(fmt.Sprintf("relationship %s conflicts with an attribute", ref), "split", "ref"))
+	}
+	if strings.ContainsAny(ref, forbiddenChars) {
+		diags = append(diags, errorAt(fmt.Sprintf("relationship name %q contains a forbidden character", ref), "split", "ref"))
+	}
+	return diags
+}
+
+// expandID replace the {name} placeholders of an ID template by vars, or else by the fields of the child.
+func expandID(template string, vars map[string]string, fields map[string]interface{}) (string, error) {
+	var out strings.Builder
+	for {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			out.WriteString(template)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed { in ID template")
+		}
+		name := template[open+1 : open+end]
+		out.WriteString(template[:open])
+		if v, ok := vars[name]; ok {
+			out.WriteString(v)
+		} else if v, ok := fields[name]; ok && v != nil {
+			out.WriteString(fmt.Sprint(v))
+		} else {
+			return "", fmt.Errorf("no %s for the ID template", name)
+		}
+		template = template[open+end+1:]
+	}
+}
+
+// placeholders return the names used in an ID template, or an error if it is invalid.
+func placeholders(template string) ([]string, error) {
+	var names []string
+	for {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			return names, nil
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in ID template %s", template)
+		}
+		if end == 1 {
+			return nil, fmt.Errorf("empty placeholder in ID template %s", template)
+		}
+		names = append(names, template[open+1:open+end])
+		template = template[open+end+1:]
+	}
+}
@@ -0,0 +1,50 @@
+package bridges
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/smartystreets/assertions"
+)
+
+func TestSplit(t *testing.T) {
+	a := assertions.New(t)
+	sch := &Schema{
+		Type:  "Gateway",
+		Attrs: map[string]string{"temp": "celsius"},
+		Split: &SchemaSplit{Field: "$.readings", ID: "{id}-{index}-{serial}", Ref: "refGateway"},
+	}
+	ents, err := decode(log.Get(), map[string]interface{}{
+		"id":       "gw",
+		"temp":     30.0,
+		"readings": []interface{}{map[string]interface{}{"serial": "a", "temp": 1.0}},
+	}, sch, nil)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ents, assertions.ShouldHaveLength, 2)
+	a.So(ents[0].Id, assertions.ShouldEqual, "gw")
+	a.So(ents[1].Id, assertions.ShouldEqual, "gw-0-a")
+	a.So(ents[1].Type, assertions.ShouldEqual, "Gateway")
+	a.So(ents[1].Attributes["temp"].Value, assertions.ShouldEqual, 1.0)
+	a.So(ents[1].Attributes["refGateway"].Value, assertions.ShouldEqual, "gw")
+
+	_, err = decode(log.Get(), map[string]interface{}{"id": "gw", "readings": []interface{}{map[string]interface{}{}}}, sch, nil)
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = decode(log.Get(), map[string]interface{}{"id": "gw", "readings": 3.0}, sch, nil)
+	a.So(err, assertions.ShouldNotBeNil)
+
+	sch.Split = &SchemaSplit{Prefixes: []string{"a", "b"}}
+	ents, err = decode(log.Get(), map[string]interface{}{"id": "gw", "a_temp": 1.0, "b_temp": 2.0}, sch, nil)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ents, assertions.ShouldHaveLength, 3)
+	a.So(ents[2].Id, assertions.ShouldEqual, "gw-b")
+	a.So(ents[2].Attributes["temp"].Value, assertions.ShouldEqual, 2.0)
+	a.So(ents[2].Attributes[defaultRef].Type, assertions.ShouldEqual, "Relationship")
+	ents, err = decode(log.Get(), map[string]interface{}{"id": "gw", "a_temp": 1.0, "battery": 3.0}, sch, nil)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(ents, assertions.ShouldHaveLength, 2)
+
+	a.So((&SchemaSplit{}).check(nil), assertions.ShouldHaveLength, 1)
+	a.So((&SchemaSplit{Field: "x", ID: "{id}"}).check(nil), assertions.ShouldHaveLength, 1)
+	a.So((&SchemaSplit{Field: "x", ID: "{id"}).check(nil), assertions.ShouldHaveLength, 1)
+	a.So((&SchemaSplit{Field: "x"}).check(map[string]string{"refDevice": "Text"}), assertions.ShouldHaveLength, 1)
+}
@@ -0,0 +1,414 @@
+package bridges
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Severity of a Diagnostic. Only errors prevent a mapper file from being loaded.
+type Severity int
+
+const (
+	Warning Severity = iota
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found in a mapper file. Line is 0 when the position is unknown.
+type Diagnostic struct {
+	Line     int
+	Severity Severity
+	Schema   string
+	Msg      string
+}
+
+func (d Diagnostic) String() string {
+	str := d.Severity.String() + ": "
+	if d.Line > 0 {
+		str = strconv.Itoa(d.Line) + ": " + str
+	}
+	if d.Schema != "" {
+		str += "schema " + d.Schema + ": "
+	}
+	return str + d.Msg
+}
+
+// Diagnostics of a mapper file, sorted by line.
+type Diagnostics []Diagnostic
+
+// HasErrors tell if at least one diagnostic is an error.
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// Err return the error diagnostics as a single error, or nil if there is none.
+func (ds Diagnostics) Err() error {
+	var msgs []string
+	for _, d := range ds {
+		if d.Severity == Error {
+			msgs = append(msgs, d.String())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// forbiddenChars cannot be used in attribute names, the broker reject them.
+const forbiddenChars = "<>\"'=;()&? \t#/"
+
+var yamlLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// ParseSchemas decode a mapper file strictly and check every schema. The schemas are returned even when there are
+// errors so the caller can report every diagnostic.
+func ParseSchemas(buff []byte) (map[string]*Schema, Diagnostics) {
+	var diags Diagnostics
+	schemas := map[string]*Schema{}
+	err := yaml.UnmarshalStrict(buff, &schemas)
+	if terr, ok := err.(*yaml.TypeError); ok {
+		for _, msg := range terr.Errors {
+			d := Diagnostic{Severity: Error, Msg: msg}
+			if m := yamlLine.FindStringSubmatch(msg); m != nil {
+				d.Line, _ = strconv.Atoi(m[1])
+				d.Msg = m[2]
+			}
+			diags = append(diags, d)
+		}
+	} else if err != nil {
+		return nil, Diagnostics{{Severity: Error, Msg: err.Error()}}
+	}
+	lines := locate(buff)
+	for _, d := range schemaDiagnostics(schemas) {
+		d.Line = lines.find(append([]string{d.Schema}, d.path...)...)
+		diags = append(diags, d.Diagnostic)
+	}
+	diags = append(diags, similarTypes(schemas, lines)...)
+	sort.SliceStable(diags, func(i, j int) bool {
+		return diags[i].Line < diags[j].Line
+	})
+	return schemas, diags
+}
+
+// checkSchemas check every schema, without locating the problems.
+func checkSchemas(schemas map[string]*Schema) Diagnostics {
+	var diags Diagnostics
+	for _, d := range schemaDiagnostics(schemas) {
+		diags = append(diags, d.Diagnostic)
+	}
+	return diags
+}
+
+// schemaDiagnostics check every schema merged with the schemas it extends.
+func schemaDiagnostics(schemas map[string]*Schema) []pathDiagnostic {
+	resolved, diags := resolve(schemas)
+	for _, key := range sortedKeys(resolved) {
+		for _, d := range resolved[key].check() {
+			d.Schema = key
+			diags = append(diags, d)
+		}
+	}
+	return diags
+}
+
+// pathDiagnostic is a diagnostic located by its key path in the schema.
+type pathDiagnostic struct {
+	Diagnostic
+	path []string
+}
+
+func errorAt(msg string, path ...string) pathDiagnostic {
+	return pathDiagnostic{Diagnostic: Diagnostic{Severity: Error, Msg: msg}, path: path}
+}
+
+// check return the problems of the schema.
+func (s *Schema) check() []pathDiagnostic {
+	if s == nil {
+		return []pathDiagnostic{errorAt("empty schema")}
+	}
+	var diags []pathDiagnostic
+	if len(s.Attrs) == 0 {
+		diags = append(diags, errorAt("no attrs defined", "attrs"))
+	}
+	diags = append(diags, s.Data.check()...)
+	names := map[string]string{}
+	for _, key := range sortedKeys(s.Attrs) {
+		name := key
+		if isSelector(key) {
+			sel, err := parseSelector(key)
+			if err != nil {
+				diags = append(diags, errorAt(err.Error(), "attrs", key))
+				continue
+			}
+			if name = sel.name(); name == "" {
+				diags = append(diags, errorAt(fmt.Sprintf("selector %s has no field name to name the attribute", key), "attrs", key))
+				continue
+			}
+		}
+		if other, ok := names[name]; ok {
+			diags = append(diags, errorAt(fmt.Sprintf("attributes %s and %s are both named %s", other, key, name), "attrs", key))
+		}
+		names[name] = key
+		switch {
+		case name == "id" || name == "type":
+			diags = append(diags, errorAt(fmt.Sprintf("attribute %s conflicts with the entity %s", name, name), "attrs", key))
+		case name == "timestamp":
+			diags = append(diags, errorAt("attribute timestamp conflicts with the timestamp added by the bridge", "attrs", key))
+		case strings.ContainsAny(name, forbiddenChars):
+			diags = append(diags, errorAt(fmt.Sprintf("attribute name %q contains a forbidden character", name), "attrs", key))
+		}
+		if _, renamed := s.Replace[key]; !renamed {
+			for _, to := range sortedKeys(s.Replace) {
+				if s.Replace[to] == key {
+					diags = append(diags, errorAt(fmt.Sprintf("attribute %s is renamed to %s by replace and never set", key, to), "attrs", key))
+				}
+			}
+		}
+	}
+	diags = append(diags, s.checkReplace()...)
+	if s.Split != nil {
+		diags = append(diags, s.Split.check(s.Attrs)...)
+	}
+	if s.Report != nil {
+		diags = append(diags, s.Report.check(s.Attrs)...)
+	}
+	if s.Dedup != nil {
+		diags = append(diags, s.Dedup.check()...)
+	}
+	if s.Limit != nil {
+		diags = append(diags, s.Limit.check()...)
+	}
+	for _, name := range sortedKeys(s.Compute) {
+		if _, err := compileExpr(s.Compute[name]); err != nil {
+			diags = append(diags, errorAt(fmt.Sprintf("expression of %s: %s", name, err), "compute", name))
+		}
+		if _, ok := s.Attrs[name]; !ok {
+			diags = append(diags, errorAt(fmt.Sprintf("computed attribute %s has no type in attrs", name), "compute", name))
+		}
+	}
+	return diags
+}
+
+// check return the problems of the data settings.
+func (d SchemaData) check() []pathDiagnostic {
+	format, err := parseFormat(d.Format)
+	if err != nil {
+		return []pathDiagnostic{errorAt(err.Error(), "data", "format")}
+	}
+	var diags []pathDiagnostic
+	if d.Field == "" && d.Format != "" {
+		diags = append(diags, errorAt("data format without data field", "data", "format"))
+	}
+	if format.name == "csv" && len(d.Columns) == 0 {
+		diags = append(diags, errorAt("csv data without columns", "data", "format"))
+	}
+	if len([]rune(d.Delimiter)) > 1 {
+		diags = append(diags, errorAt("delimiter must be a single character", "data", "delimiter"))
+	}
+	if format.name == "binary" && len(d.Layout) == 0 {
+		diags = append(diags, errorAt("binary data without layout", "data", "format"))
+	}
+	names := map[string]bool{}
+	for _, f := range d.Layout {
+		if names[f.Name] {
+			diags = append(diags, errorAt(fmt.Sprintf("layout field %s defined twice", f.Name), "data", "layout"))
+		}
+		names[f.Name] = true
+		for _, msg := range f.check() {
+			diags = append(diags, errorAt(msg, "data", "layout"))
+		}
+	}
+	return diags
+}
+
+// checkReplace detect renaming cycles and fields renamed twice. Replace map the new name to the original one.
+func (s *Schema) checkReplace() []pathDiagnostic {
+	var diags []pathDiagnostic
+	from := map[string]string{}
+	for _, to := range sortedKeys(s.Replace) {
+		orig := s.Replace[to]
+		if isSelector(orig) {
+			// Selected values are copied, they can be selected twice.
+			if _, err := parseSelector(orig); err != nil {
+				diags = append(diags, errorAt(err.Error(), "replace", to))
+			}
+			continue
+		}
+		if other, ok := from[orig]; ok {
+			diags = append(diags, errorAt(fmt.Sprintf("%s is renamed to both %s and %s", orig, other, to), "replace", to))
+		}
+		from[orig] = to
+	}
+	reported := map[string]bool{}
+	for _, start := range sortedKeys(s.Replace) {
+		chain := []string{start}
+		for cur := s.Replace[start]; ; cur = s.Replace[cur] {
+			if cur == start {
+				if !reported[start] {
+					for _, k := range chain {
+						reported[k] = true
+					}
+					diags = append(diags, errorAt(fmt.Sprintf("replace cycle %s -> %s", strings.Join(chain, " -> "), start), "replace", start))
+				}
+				break
+			}
+			if _, ok := s.Replace[cur]; !ok || len(chain) > len(s.Replace) {
+				break
+			}
+			chain = append(chain, cur)
+		}
+	}
+	return diags
+}
+
+// similarTypes warn about attribute types that look like a typo of another type used in the file.
+func similarTypes(schemas map[string]*Schema, lines lineIndex) Diagnostics {
+	type use struct {
+		schema, attr string
+	}
+	uses := map[string]use{}
+	for _, key := range sortedKeys(schemas) {
+		if schemas[key] == nil {
+			continue
+		}
+		for _, attr := range sortedKeys(schemas[key].Attrs) {
+			if t := schemas[key].Attrs[attr]; t != "" {
+				if _, ok := uses[t]; !ok {
+					uses[t] = use{key, attr}
+				}
+			}
+		}
+	}
+	types := make([]string, 0, len(uses))
+	for t := range uses {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	var diags Diagnostics
+	for i, a := range types {
+		for _, b := range types[i+1:] {
+			if len(a) < 5 || len(b) < 5 || distance(a, b) > 1 {
+				continue
+			}
+			// Report on the last of the two uses, naming the first one.
+			first, last := a, b
+			lf, ll := lines.find(uses[a].schema, "attrs", uses[a].attr), lines.find(uses[b].schema, "attrs", uses[b].attr)
+			if lf > ll {
+				first, last, ll = b, a, lf
+			}
+			diags = append(diags, Diagnostic{
+				Line:     ll,
+				Severity: Warning,
+				Schema:   uses[last].schema,
+				Msg:      fmt.Sprintf("attribute types %q and %q (schema %s) look alike", last, first, uses[first].schema),
+			})
+		}
+	}
+	return diags
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// sortedKeys return the sorted keys of a map with string keys.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lineIndex give the line of the keys of a YAML document by their path, for block mappings.
+type lineIndex map[string]int
+
+func locate(buff []byte) lineIndex {
+	idx := lineIndex{}
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+	scanner := bufio.NewScanner(bytes.NewReader(buff))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		colon := strings.Index(trimmed, ":")
+		if colon <= 0 {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		key := strings.Trim(trimmed[:colon], `"'`)
+		stack = append(stack, level{indent, key})
+		path := make([]string, len(stack))
+		for i, l := range stack {
+			path[i] = l.key
+		}
+		idx[strings.Join(path, "\x00")] = n
+	}
+	return idx
+}
+
+// find return the line of the deepest known key of path.
+func (idx lineIndex) find(path ...string) int {
+	for i := len(path); i > 0; i-- {
+		if n, ok := idx[strings.Join(path[:i], "\x00")]; ok {
+			return n
+		}
+	}
+	return 0
+}
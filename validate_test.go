@@ -0,0 +1,67 @@
+package bridges
+
+import (
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestParseSchemas(t *testing.T) {
+	a := assertions.New(t)
+	_, diags := ParseSchemas([]byte(`default:
+  attrs:
+    temp: celsius
+  release: valve
+particle:
+  replace:
+    id: coreid
+    coreid: id
+  attrs:
+    temp1: celcius
+    timestamp: time
+  data:
+    format: xml
+empty:
+  type: Tank
+`))
+	var lines []int
+	var msgs []string
+	for _, d := range diags {
+		lines = append(lines, d.Line)
+		msgs = append(msgs, d.Schema+": "+d.Msg)
+	}
+	a.So(diags.HasErrors(), assertions.ShouldBeTrue)
+	a.So(lines, assertions.ShouldResemble, []int{4, 8, 10, 11, 13, 14})
+	a.So(msgs, assertions.ShouldResemble, []string{
+		": field release not found in type bridges.Schema",
+		"particle: replace cycle coreid -> id -> coreid",
+		`particle: attribute types "celcius" and "celsius" (schema default) look alike`,
+		"particle: attribute timestamp conflicts with the timestamp added by the bridge",
+		`particle: unsupported data format "xml"`,
+		"empty: no attrs defined",
+	})
+
+	_, diags = ParseSchemas([]byte(`sensor:
+  attrs:
+    level: meter
+  data:
+    field: payload
+    format: base64+csv
+    delimiter: ";;"
+`))
+	a.So(diags.Err().Error(), assertions.ShouldEqual, "6: error: schema sensor: csv data without columns; 7: error: schema sensor: delimiter must be a single character")
+
+	_, diags = ParseSchemas([]byte(`tank:
+  attrs:
+    level: meter
+  compute:
+    fill: level / params.height
+    level: "'full' * 2"
+`))
+	a.So(diags.Err().Error(), assertions.ShouldEqual, "5: error: schema tank: computed attribute fill has no type in attrs; "+
+		"6: error: schema tank: expression of level: column 8: * of a string and a number")
+
+	schemas, diags := ParseSchemas([]byte("tank:\n  attrs:\n    level: meter\n"))
+	a.So(diags, assertions.ShouldBeEmpty)
+	a.So(schemas["tank"].Attrs["level"], assertions.ShouldEqual, "meter")
+}
@@ -0,0 +1,48 @@
+package bridges
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+// watchFile call reload when changed tell the file was modified, checking every interval, or when the process
+// receive SIGHUP. what name the reloaded content in the logs. It return a function stopping the watch.
+func watchFile(ctx log.Interface, interval time.Duration, changed func() bool, reload func() error, what string) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !changed() {
+					continue
+				}
+			case <-hup:
+			}
+			if err := reload(); err != nil {
+				ctx.WithError(err).Warnf("Could not reload %s, keeping the current ones.", what)
+				continue
+			}
+			ctx.Infof("Reloaded %s.", what)
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// modified tell if the file was modified since t.
+func modified(file string, t time.Time) bool {
+	info, err := os.Stat(file)
+	return err == nil && !info.ModTime().Equal(t)
+}